@@ -39,17 +39,28 @@ func SetDefaultServiceLimits(config *rcmgr.ScalingLimitConfig) {
 	}
 
 	//  ping
-	addServiceAndProtocolLimit(config,
-		ping.ServiceName, ping.ID,
+	config.AddServiceLimit(
+		ping.ServiceName,
 		rcmgr.BaseLimit{StreamsInbound: 64, StreamsOutbound: 64, Streams: 64, Memory: 4 << 20},
 		rcmgr.BaseLimitIncrease{StreamsInbound: 64, StreamsOutbound: 64, Streams: 64, Memory: 4 << 20},
 	)
-	addServicePeerAndProtocolPeerLimit(
-		config,
-		ping.ServiceName, ping.ID,
+	config.AddServicePeerLimit(
+		ping.ServiceName,
 		rcmgr.BaseLimit{StreamsInbound: 2, StreamsOutbound: 3, Streams: 4, Memory: 32 * (256<<20 + 16<<10)},
 		rcmgr.BaseLimitIncrease{},
 	)
+	for _, id := range [...]protocol.ID{ping.ID, ping.TimestampID, ping.TimestampExtID, ping.SizedID, ping.KeepaliveID} {
+		config.AddProtocolLimit(
+			id,
+			rcmgr.BaseLimit{StreamsInbound: 64, StreamsOutbound: 64, Streams: 64, Memory: 4 << 20},
+			rcmgr.BaseLimitIncrease{StreamsInbound: 64, StreamsOutbound: 64, Streams: 64, Memory: 4 << 20},
+		)
+		config.AddProtocolPeerLimit(
+			id,
+			rcmgr.BaseLimit{StreamsInbound: 2, StreamsOutbound: 3, Streams: 4, Memory: 32 * (256<<20 + 16<<10)},
+			rcmgr.BaseLimitIncrease{},
+		)
+	}
 
 	// autonat
 	addServiceAndProtocolLimit(config,
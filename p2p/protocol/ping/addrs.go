@@ -0,0 +1,159 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// errAddrDialUnsupported is returned by PingAllAddrs when the host's network
+// can't dial specific addresses.
+var errAddrDialUnsupported = errors.New("network doesn't support dialing specific addresses")
+
+// transportDialer is implemented by networks that expose their transports,
+// like the swarm.
+type transportDialer interface {
+	TransportForDialing(ma.Multiaddr) transport.Transport
+}
+
+// PingAllAddrs pings p once over each of its addresses known to the
+// peerstore, and returns the results by address.
+func PingAllAddrs(ctx context.Context, h host.Host, p peer.ID) map[ma.Multiaddr]Result {
+	return newPingService(h).PingAllAddrs(ctx, p)
+}
+
+// PingAllAddrs pings p once over each of its addresses known to the
+// peerstore, and returns the results by address. Existing connections to an
+// address are reused and left open. Otherwise, a probe connection is dialed
+// to the address, bypassing the host's connection management, and closed
+// after the round. The addresses are probed one after another, so that the
+// probes don't skew each other's RTTs.
+func (ps *PingService) PingAllAddrs(ctx context.Context, p peer.ID) map[ma.Multiaddr]Result {
+	addrs := ps.Host.Peerstore().Addrs(p)
+	results := make(map[ma.Multiaddr]Result, len(addrs))
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			results[addr] = Result{Time: time.Now(), Error: ctx.Err()}
+			continue
+		}
+		results[addr] = ps.pingAddr(ctx, p, addr)
+	}
+	return results
+}
+
+// pingAddr pings p once over addr.
+func (ps *PingService) pingAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) Result {
+	start := time.Now()
+	for _, c := range ps.Host.Network().ConnsToPeer(p) {
+		if !c.RemoteMultiaddr().Equal(addr) {
+			continue
+		}
+		res := Result{Time: start, Transport: transportName(addr), Conn: c.ID()}
+		s, err := ps.openStreamOn(ctx, c)
+		if err != nil {
+			res.Error = &PingError{Peer: p, Conn: c, Op: "open", Err: err}
+			return res
+		}
+		res.StreamOpen = time.Since(start)
+		ra, err := newRand()
+		if err == nil {
+			var dres DetailedResult
+			dres, err = ps.pingWithTimeout(ctx, s, ra, true)
+			res.RTT = dres.RTT
+		}
+		if err != nil {
+			s.Reset()
+			res.Error = err
+			return res
+		}
+		s.Close()
+		return res
+	}
+	return ps.probeAddr(ctx, p, addr)
+}
+
+// probeAddr pings p once over a new connection to addr, dialed with the
+// transport for addr directly.
+func (ps *PingService) probeAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) Result {
+	res := Result{Time: time.Now(), Transport: transportName(addr), Dialed: true}
+	fail := func(err error) Result {
+		res.Error = &PingError{Peer: p, Op: "open", Err: err}
+		return res
+	}
+
+	td, ok := ps.Host.Network().(transportDialer)
+	if !ok {
+		return fail(errAddrDialUnsupported)
+	}
+	tpt := td.TransportForDialing(addr)
+	if tpt == nil {
+		return fail(errors.New("no transport for address"))
+	}
+
+	timeout, _ := ps.roundTimeout(ctx)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c, err := tpt.Dial(ctx, addr, p)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.Close()
+	s, err := c.OpenStream(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer s.Close()
+
+	// reset the stream if the context is done mid-round
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Reset()
+		case <-done:
+		}
+	}()
+
+	if err := msmux.SelectProtoOrFail(string(ID), s); err != nil {
+		return fail(err)
+	}
+	res.StreamOpen = time.Since(res.Time)
+
+	ra, err := newRand()
+	if err != nil {
+		return fail(err)
+	}
+	buf := ps.getBuf(PingSize)
+	defer ps.putBuf(buf)
+	rbuf := ps.getBuf(PingSize)
+	defer ps.putBuf(rbuf)
+	if _, err := io.ReadFull(ra, buf); err != nil {
+		return fail(err)
+	}
+	before := time.Now()
+	if err = writeFull(s, buf); err == nil {
+		_, err = io.ReadFull(s, rbuf)
+	}
+	if err == nil {
+		err = ps.verify(buf, rbuf)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		res.Error = &PingError{Peer: p, Op: "round", Err: err}
+		return res
+	}
+	res.RTT = time.Since(before)
+	return res
+}
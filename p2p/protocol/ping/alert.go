@@ -0,0 +1,68 @@
+package ping
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// AlertLevel is the alert level of a peer, as determined by its smoothed RTT
+// and the thresholds set with the AlertThresholds option.
+type AlertLevel int
+
+const (
+	AlertOK AlertLevel = iota
+	AlertWarn
+	AlertCritical
+)
+
+func (l AlertLevel) String() string {
+	switch l {
+	case AlertOK:
+		return "ok"
+	case AlertWarn:
+		return "warn"
+	case AlertCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+// EvtPingAlert is emitted on the host's event bus when the alert level of a
+// pinged peer changes.
+type EvtPingAlert struct {
+	Peer        peer.ID
+	Level       AlertLevel
+	SmoothedRTT time.Duration
+	// Tag is the session tag of the ping session that triggered the
+	// transition, if any.
+	Tag any
+	// Transport is the transport of the stream of the round that triggered
+	// the transition, see Result.Transport.
+	Transport string
+}
+
+type alertThresholds struct {
+	warn, critical, hysteresis time.Duration
+}
+
+// level returns the alert level for the smoothed RTT rtt, given the current
+// level. Levels are only left once rtt drops below the threshold by more than
+// the hysteresis, to avoid flapping.
+func (t *alertThresholds) level(cur AlertLevel, rtt time.Duration) AlertLevel {
+	crossed := func(l AlertLevel, threshold time.Duration) bool {
+		if cur >= l {
+			threshold -= t.hysteresis
+		}
+		return rtt >= threshold
+	}
+	switch {
+	case crossed(AlertCritical, t.critical):
+		return AlertCritical
+	case crossed(AlertWarn, t.warn):
+		return AlertWarn
+	default:
+		return AlertOK
+	}
+}
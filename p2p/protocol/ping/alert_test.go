@@ -0,0 +1,31 @@
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertLevelHysteresis(t *testing.T) {
+	ms := time.Millisecond
+	th := &alertThresholds{warn: 100 * ms, critical: 200 * ms, hysteresis: 20 * ms}
+
+	level := AlertOK
+	for _, step := range []struct {
+		rtt      time.Duration
+		expected AlertLevel
+	}{
+		{50 * ms, AlertOK},
+		{100 * ms, AlertWarn},
+		{90 * ms, AlertWarn}, // within hysteresis
+		{250 * ms, AlertCritical},
+		{190 * ms, AlertCritical}, // within hysteresis
+		{179 * ms, AlertWarn},
+		{79 * ms, AlertOK},
+		{99 * ms, AlertOK},
+	} {
+		level = th.level(level, step.rtt)
+		require.Equal(t, step.expected, level, "rtt %s", step.rtt)
+	}
+}
@@ -0,0 +1,108 @@
+package ping
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// bgSession is a ping session started with StartBackground.
+type bgSession struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mx   sync.Mutex
+	rtt  time.Duration
+	time time.Time // zero until the first successful round
+}
+
+// StartBackground starts pinging p in the background, keeping the latest RTT
+// for LatestRTT to return. It is a no-op if a background session to p is
+// already running. The session runs until StopBackground is called, and
+// reopens failed streams like a Resilient one, with the backoff set with
+// Resilient if any, including while p can't be reached at all.
+func (ps *PingService) StartBackground(p peer.ID) {
+	ps.bgMx.Lock()
+	defer ps.bgMx.Unlock()
+
+	if _, ok := ps.background[p]; ok {
+		return
+	}
+	if ps.background == nil {
+		ps.background = make(map[peer.ID]*bgSession)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &bgSession{cancel: cancel, done: make(chan struct{})}
+	ps.background[p] = sess
+
+	initialBackoff := ps.reopenBackoff
+	if initialBackoff == 0 {
+		initialBackoff = defaultReopenBackoff
+	}
+	go func() {
+		defer close(sess.done)
+		// The session ends if its first stream can't be opened, e.g. while
+		// the peer is unreachable. It is restarted with the same backoff as
+		// failed streams are reopened with.
+		backoff := initialBackoff
+		for {
+			for res := range ps.pingDetailed(ctx, p, initialBackoff) {
+				if res.Error != nil {
+					continue
+				}
+				backoff = initialBackoff
+				sess.mx.Lock()
+				sess.rtt = res.RTT
+				sess.time = res.Time
+				sess.mx.Unlock()
+			}
+
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+			backoff *= 2
+			if backoff > maxReopenBackoff {
+				backoff = maxReopenBackoff
+			}
+		}
+	}()
+}
+
+// StopBackground stops the background session to p started with
+// StartBackground, and waits for it to end.
+func (ps *PingService) StopBackground(p peer.ID) {
+	ps.bgMx.Lock()
+	sess, ok := ps.background[p]
+	delete(ps.background, p)
+	ps.bgMx.Unlock()
+
+	if ok {
+		sess.cancel()
+		<-sess.done
+	}
+}
+
+// LatestRTT returns the RTT of the latest successful round of the background
+// session to p, and when the round started. It reports false if there's no
+// background session to p, or no round succeeded yet.
+func (ps *PingService) LatestRTT(p peer.ID) (time.Duration, time.Time, bool) {
+	ps.bgMx.Lock()
+	sess, ok := ps.background[p]
+	ps.bgMx.Unlock()
+	if !ok {
+		return 0, time.Time{}, false
+	}
+
+	sess.mx.Lock()
+	defer sess.mx.Unlock()
+	if sess.time.IsZero() {
+		return 0, time.Time{}, false
+	}
+	return sess.rtt, sess.time, true
+}
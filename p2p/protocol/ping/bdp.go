@@ -0,0 +1,88 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// number of rounds of every payload size measured by MeasureBDP
+const bdpRounds = 5
+
+// BDPEstimate is an estimate of the bandwidth-delay product to a peer, along
+// with the measurements it is derived from.
+type BDPEstimate struct {
+	// RTT is the lowest RTT measured with PingSize payloads.
+	RTT time.Duration
+	// Throughput is the achievable throughput in bytes per second, derived
+	// from the RTT increase of MaxPayloadSize payloads over PingSize ones,
+	// assuming a symmetric path.
+	Throughput float64
+	// Bytes is the bandwidth-delay product, that is Throughput times RTT.
+	Bytes int
+}
+
+// EstimateBDP estimates the bandwidth-delay product to p in bytes, useful for
+// tuning window sizes. See MeasureBDP for the measurements it is derived from.
+func EstimateBDP(ctx context.Context, h host.Host, p peer.ID) (bytes int, err error) {
+	est, err := newPingService(h).MeasureBDP(ctx, p)
+	return est.Bytes, err
+}
+
+// MeasureBDP pings p with alternating PingSize and MaxPayloadSize payloads
+// over the SizedID protocol, and estimates the bandwidth-delay product from
+// the lowest RTT of either size. Both are reported along with the estimate.
+func (ps *PingService) MeasureBDP(ctx context.Context, p peer.ID) (BDPEstimate, error) {
+	var est BDPEstimate
+	sized := newPingService(ps.Host)
+	sized.allowSelf = ps.allowSelf
+	sized.payloadSize = PingSize
+	sized.reservePriority = ps.reservePriority
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, _, err := sized.openStream(ctx, p)
+	if err != nil {
+		return est, err
+	}
+	defer s.Reset()
+
+	ra, err := newRand()
+	if err != nil {
+		return est, err
+	}
+
+	var small, large time.Duration
+	for i := 0; i < 2*bdpRounds; i++ {
+		size := PingSize
+		if i%2 == 1 {
+			size = MaxPayloadSize
+		}
+		t := time.AfterFunc(probeTimeout, func() { s.Reset() })
+		res, err := sized.pingSized(s, ra, size)
+		t.Stop()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return est, err
+		}
+		if size == PingSize && (small == 0 || res.RTT < small) {
+			small = res.RTT
+		}
+		if size == MaxPayloadSize && (large == 0 || res.RTT < large) {
+			large = res.RTT
+		}
+	}
+
+	est.RTT = small
+	if large <= small {
+		return est, errors.New("payload size had no measurable effect on the RTT")
+	}
+	// the extra bytes of the larger payloads are sent and echoed back
+	est.Throughput = 2 * float64(MaxPayloadSize-PingSize) / (large - small).Seconds()
+	est.Bytes = int(est.Throughput * small.Seconds())
+	return est, nil
+}
@@ -0,0 +1,94 @@
+package ping
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// default window of BucketedResults
+const defaultBucketWindow = 10 * time.Second
+
+// WindowStat summarizes the results of a ping session over a time window.
+type WindowStat struct {
+	// Start is the start of the window, Duration its length.
+	Start    time.Time
+	Duration time.Duration
+	// Partial is set on the last window of a session if the session ended
+	// before the window did.
+	Partial bool
+
+	// Count is the number of successful rounds, Errors the number of failed
+	// ones. Min, Avg and Max are only set if Count is not zero.
+	Count, Errors int
+	Min, Avg, Max time.Duration
+}
+
+type windowAccumulator struct {
+	stat WindowStat
+	sum  time.Duration
+}
+
+func (w *windowAccumulator) add(res Result) {
+	st := &w.stat
+	if res.Error != nil {
+		st.Errors++
+		return
+	}
+	if st.Count == 0 || res.RTT < st.Min {
+		st.Min = res.RTT
+	}
+	if res.RTT > st.Max {
+		st.Max = res.RTT
+	}
+	st.Count++
+	w.sum += res.RTT
+	st.Avg = w.sum / time.Duration(st.Count)
+}
+
+// BucketedResults pings the remote peer until the context is canceled, like
+// Ping, but delivers one WindowStat per window of the duration set with the
+// BucketBy option (10s by default) instead of individual results. A window is
+// delivered even if it holds no results.
+//
+// When the session ends, a partial last window is delivered if it holds any
+// results, so the channel must be drained until it is closed.
+func (ps *PingService) BucketedResults(ctx context.Context, p peer.ID) <-chan WindowStat {
+	d := ps.bucketWindow
+	if d <= 0 {
+		d = defaultBucketWindow
+	}
+
+	results := ps.Ping(ctx, p)
+	out := make(chan WindowStat)
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		w := windowAccumulator{stat: WindowStat{Start: time.Now(), Duration: d}}
+		for {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					if w.stat.Count+w.stat.Errors > 0 {
+						w.stat.Partial = true
+						w.stat.Duration = time.Since(w.stat.Start)
+						out <- w.stat
+					}
+					return
+				}
+				w.add(res)
+			case now := <-ticker.C:
+				select {
+				case out <- w.stat:
+				case <-ctx.Done():
+					// the results channel gets closed
+				}
+				w = windowAccumulator{stat: WindowStat{Start: now, Duration: d}}
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,1177 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// maximum backoff between attempts to reopen a ping stream in resilient mode
+const maxReopenBackoff = time.Minute
+
+// seed of the random source deciding which rounds are dropped, for the same
+// rounds to be dropped in every session
+const dropSeed = 1
+
+// how long a round in progress may take to complete when the session is
+// canceled, before its stream is reset
+const closeGrace = time.Second
+
+// how long to wait for unsolicited data before a round
+const unsolicitedWait = time.Millisecond
+
+// initial backoff before reopening a failed ping stream when a fresh stream is
+// used per round outside of resilient mode, or by a background session
+const defaultReopenBackoff = time.Second
+
+var errPayloadMismatch = errors.New("ping packet was incorrect")
+
+// verify checks that the echo received for a payload is correct.
+func (ps *PingService) verify(sent, received []byte) error {
+	if ps.verifyFunc != nil {
+		if err := ps.verifyFunc(sent, received); err != nil {
+			return fmt.Errorf("%w: %s", errPayloadMismatch, err)
+		}
+		return nil
+	}
+	if !bytes.Equal(sent, received) {
+		return errPayloadMismatch
+	}
+	return nil
+}
+
+func (ps *PingService) Ping(ctx context.Context, p peer.ID) <-chan Result {
+	// don't open a stream if the context is already done
+	if err := ctx.Err(); err != nil {
+		return pingError(err)
+	}
+	detailed := ps.PingDetailed(ctx, p)
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		for res := range detailed {
+			select {
+			case out <- res.Result:
+			case <-ctx.Done():
+				// wait for the session to be torn down
+				for range detailed {
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func pingError(err error) chan Result {
+	ch := make(chan Result, 1)
+	ch <- Result{Time: time.Now(), Error: err}
+	close(ch)
+	return ch
+}
+
+func detailedPingError(err error) chan DetailedResult {
+	ch := make(chan DetailedResult, 1)
+	ch <- DetailedResult{Result: Result{Time: time.Now(), Error: err}}
+	close(ch)
+	return ch
+}
+
+// Ping pings the remote peer until the context is canceled, returning a stream
+// of RTTs or errors.
+func Ping(ctx context.Context, h host.Host, p peer.ID) <-chan Result {
+	return newPingService(h).Ping(ctx, p)
+}
+
+// PingOnce pings the remote peer once.
+func PingOnce(ctx context.Context, h host.Host, p peer.ID) Result {
+	return newPingService(h).PingOnce(ctx, p)
+}
+
+// PingOnce pings the remote peer once.
+func (ps *PingService) PingOnce(ctx context.Context, p peer.ID) Result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res, ok := <-ps.Ping(ctx, p)
+	if !ok {
+		return Result{Time: time.Now(), Error: ctx.Err()}
+	}
+	return res
+}
+
+// PingDetailedOnce pings the remote peer once over a new stream, and returns
+// the detailed result of the round. The stream is cleaned up before it
+// returns.
+func PingDetailedOnce(ctx context.Context, h host.Host, p peer.ID) (DetailedResult, error) {
+	return newPingService(h).PingDetailedOnce(ctx, p)
+}
+
+// PingDetailedOnce pings the remote peer once over a new stream. See the
+// package level PingDetailedOnce.
+func (ps *PingService) PingDetailedOnce(ctx context.Context, p peer.ID) (DetailedResult, error) {
+	if err := ctx.Err(); err != nil {
+		return DetailedResult{}, err
+	}
+	if p == ps.Host.ID() && !ps.allowSelf {
+		return DetailedResult{}, ErrPingSelf
+	}
+
+	start := time.Now()
+	s, dialed, err := ps.openInitialStream(ctx, p)
+	if err != nil {
+		return DetailedResult{}, err
+	}
+	opened := time.Since(start)
+
+	// reset the stream if the context is canceled mid-round
+	done := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			s.Reset()
+		case <-done:
+		}
+	}()
+
+	var res DetailedResult
+	ra, err := newRand()
+	if err == nil {
+		res, err = ps.pingWithTimeout(ctx, s, ra, true)
+	}
+	close(done)
+	<-watcherDone
+
+	if err != nil {
+		s.Reset()
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		ps.traceRound(ctx, p, start, Result{Error: err, Transport: transportName(s.Conn().RemoteMultiaddr())})
+		return res, err
+	}
+	s.Close()
+
+	res.Time = start
+	res.Dialed = dialed
+	res.StreamOpen = opened
+	res.Transport = transportName(s.Conn().RemoteMultiaddr())
+	ps.metricsTracer.StreamOpenTime(res.Transport, opened)
+	res.Conn = s.Conn().ID()
+	res.Direction = s.Conn().Stat().Direction
+	ps.traceRound(ctx, p, start, res.Result)
+	return res, nil
+}
+
+// PingDetailed pings the remote peer until the context is canceled, returning
+// a stream of detailed results.
+func (ps *PingService) PingDetailed(ctx context.Context, p peer.ID) <-chan DetailedResult {
+	return ps.pingDetailed(ctx, p, ps.reopenBackoff)
+}
+
+// pingDetailed runs a session like PingDetailed, reopening failed streams
+// with the given initial backoff if non-zero, as set with Resilient.
+func (ps *PingService) pingDetailed(ctx context.Context, p peer.ID, reopenBackoff time.Duration) <-chan DetailedResult {
+	if err := ctx.Err(); err != nil {
+		return detailedPingError(err)
+	}
+	if p == ps.Host.ID() && !ps.allowSelf {
+		return detailedPingError(ErrPingSelf)
+	}
+
+	start := time.Now()
+	s, dialed, err := ps.openInitialStream(ctx, p)
+	if err != nil {
+		return detailedPingError(err)
+	}
+	opened := time.Since(start)
+
+	ra, err := newRand()
+	if err != nil {
+		s.Reset()
+		return detailedPingError(err)
+	}
+
+	sess := &session{
+		ps:        ps,
+		p:         p,
+		tag:       GetSessionTag(ctx),
+		rand:      ra,
+		stream:    s,
+		dialed:    dialed,
+		opened:    opened,
+		backoff:   reopenBackoff,
+		transport: transportName(s.Conn().RemoteMultiaddr()),
+		conn:      s.Conn().ID(),
+	}
+	var cancel context.CancelFunc
+	if ps.duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, ps.duration)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	ps.metricsTracer.StreamOpenTime(sess.transport, opened)
+	sess.st = ps.addSession(p)
+	sess.stream = &countingStream{Stream: s, st: sess.st}
+	sess.streamEvent(StreamOpened, nil)
+	notifee := sess.connEvents.notifee(p)
+	ps.Host.Network().Notify(notifee)
+	out := make(chan DetailedResult)
+	aborted := make(chan struct{})
+	go func() {
+		defer close(out)
+		defer ps.removeSession(p)
+		defer ps.Host.Network().StopNotify(notifee)
+
+		if ps.loadStreams > 0 {
+			defer sess.startLoad(ctx)()
+		}
+		sess.run(ctx, out)
+		cancel()
+		<-aborted
+		sess.closeStream()
+	}()
+	go func() {
+		defer close(aborted)
+		// forces the ping to abort.
+		<-ctx.Done()
+		sess.abort()
+	}()
+
+	return out
+}
+
+// newRand returns a pseudo-random source for ping payloads, seeded from a
+// cryptographic random source.
+func newRand() (io.Reader, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("failed to get cryptographic random: %s", err)
+		return nil, err
+	}
+	return mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(b)))), nil
+}
+
+// protocols returns the protocols to negotiate on outbound ping streams, in
+// order of preference.
+func (ps *PingService) protocols() []protocol.ID {
+	switch {
+	case ps.payloadSize > 0:
+		return []protocol.ID{SizedID}
+	case ps.timestamps:
+		return append([]protocol.ID{TimestampExtID, TimestampID, ID}, ps.extraIDs...)
+	default:
+		return append([]protocol.ID{ID}, ps.extraIDs...)
+	}
+}
+
+// openStream opens a new ping stream to p. It reports whether a new
+// connection had to be dialed for it.
+func (ps *PingService) openStream(ctx context.Context, p peer.ID) (s network.Stream, dialed bool, err error) {
+	return ps.openStreamTo(ctx, p, ps.protocols())
+}
+
+// openStreamTo opens a new stream to p, negotiating one of protos, like
+// openStream.
+func (ps *PingService) openStreamTo(ctx context.Context, p peer.ID, protos []protocol.ID) (s network.Stream, dialed bool, err error) {
+	h := ps.Host
+	connected := h.Network().Connectedness(p) == network.Connected
+	dialCtx, cancel := ps.dialContext(ctx)
+	defer cancel()
+	s, err = h.NewStream(network.WithUseTransient(dialCtx, "ping"), p, protos...)
+	if err != nil {
+		if len(h.Network().ListenAddresses()) == 0 && h.Network().Connectedness(p) != network.Connected {
+			err = fmt.Errorf("%w: %s", ErrHostNotReady, err)
+		} else if ctx.Err() == nil && dialCtx.Err() != nil {
+			err = fmt.Errorf("dial timed out after %s: %w", ps.dialTimeout, err)
+		}
+		return nil, false, &PingError{Peer: p, Op: "open", Err: err}
+	}
+	if err := ps.prepareStream(s); err != nil {
+		return nil, false, &PingError{Peer: p, Conn: s.Conn(), Op: "open", Err: err}
+	}
+	return s, !connected, nil
+}
+
+// dialContext derives the context of opening a stream, capped to the dial
+// timeout if set.
+func (ps *PingService) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ps.dialTimeout > 0 {
+		return context.WithTimeout(ctx, ps.dialTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// openInitialStream opens the first ping stream of a session to p, retrying
+// as set with DialRetries.
+func (ps *PingService) openInitialStream(ctx context.Context, p peer.ID) (s network.Stream, dialed bool, err error) {
+	return ps.openInitialStreamTo(ctx, p, ps.protocols())
+}
+
+// openInitialStreamTo opens the first stream of a session to p, negotiating
+// one of protos, like openInitialStream.
+func (ps *PingService) openInitialStreamTo(ctx context.Context, p peer.ID, protos []protocol.ID) (s network.Stream, dialed bool, err error) {
+	for attempt := 0; ; attempt++ {
+		s, dialed, err = ps.openStreamTo(ctx, p, protos)
+		if err == nil || attempt >= ps.dialRetries || ctx.Err() != nil {
+			return s, dialed, err
+		}
+		ps.debugf(p, "failed to open ping stream to %s, retrying: %s", p, err)
+		t := time.NewTimer(ps.dialBackoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, false, err
+		}
+	}
+}
+
+// openStreamOn opens a new ping stream over the given connection.
+func (ps *PingService) openStreamOn(ctx context.Context, c network.Conn) (network.Stream, error) {
+	return ps.openStreamWith(ctx, c, ps.protocols())
+}
+
+// openStreamWith opens a new stream over the given connection, negotiating
+// one of protos.
+func (ps *PingService) openStreamWith(ctx context.Context, c network.Conn, protos []protocol.ID) (network.Stream, error) {
+	ctx, cancel := ps.dialContext(ctx)
+	defer cancel()
+	s, err := c.NewStream(network.WithUseTransient(ctx, "ping"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Negotiate the protocol in the background, obeying the context.
+	var selected string
+	errCh := make(chan error, 1)
+	go func() {
+		var err error
+		selected, err = msmux.SelectOneOf(protocol.ConvertToStrings(protos), s)
+		errCh <- err
+	}()
+	select {
+	case err = <-errCh:
+		if err != nil {
+			s.Reset()
+			return nil, err
+		}
+	case <-ctx.Done():
+		s.Reset()
+		<-errCh
+		return nil, ctx.Err()
+	}
+	s.SetProtocol(protocol.ID(selected))
+
+	if err := ps.prepareStream(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepareStream sets up a newly opened ping stream. The stream is reset if
+// that fails.
+func (ps *PingService) prepareStream(s network.Stream) error {
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		log.Debugf("error attaching stream to ping service: %s", err)
+		s.Reset()
+		return err
+	}
+	if ps.lowLatency {
+		setNoDelay(s)
+	}
+	if ps.beforeStream != nil {
+		if err := ps.beforeStream(s); err != nil {
+			s.Reset()
+			return err
+		}
+	}
+	return nil
+}
+
+// noDelaySetter is implemented by streams and connections that can disable
+// send coalescing.
+type noDelaySetter interface {
+	SetNoDelay(bool) error
+}
+
+// setNoDelay disables send coalescing on the stream, or its connection, if
+// supported. It is a no-op otherwise.
+func setNoDelay(s network.Stream) {
+	var nd noDelaySetter
+	if v, ok := s.(noDelaySetter); ok {
+		nd = v
+	} else if v, ok := s.Conn().(noDelaySetter); ok {
+		nd = v
+	} else {
+		return
+	}
+	if err := nd.SetNoDelay(true); err != nil {
+		log.Debugf("failed to disable send coalescing on ping stream: %s", err)
+	}
+}
+
+// session is an outbound ping session to a single peer.
+type session struct {
+	ps   *PingService
+	p    peer.ID
+	tag  any
+	st   *peerState
+	rand io.Reader
+
+	// initial backoff before reopening a failed stream, zero if the
+	// session isn't resilient
+	backoff time.Duration
+
+	rounds int // number of results delivered
+	// number of rounds since the last measured one, see MeasureEvery
+	unmeasured int
+	// decides which rounds are dropped, see DropRate
+	drops *mrand.Rand
+	// statistics of the delivered results, see ContinueFunc
+	acc statsAccumulator
+	// set once a round succeeded, see SkipFirstLatencyRecord
+	sampled bool
+	// when the current stream carried its first round, see
+	// StreamRotateInterval
+	streamSince time.Time
+	// direct connection to open the next stream on, set when the current
+	// stream was closed to migrate off a transient connection
+	migrateTo network.Conn
+	// set when the current stream was opened by a migration, until the first
+	// round over it was reported
+	migrated bool
+	// recent connection events to the peer, attached to failed results
+	connEvents connEvents
+
+	// set when the current stream required dialing a new connection, until
+	// the first round over it was reported
+	dialed bool
+	// time it took to open the current stream, until the first round over
+	// it was reported
+	opened time.Duration
+	// transport and connection ID of the current stream
+	transport string
+	conn      string
+
+	streamMx sync.Mutex
+	stream   network.Stream // nil while the stream is being reopened
+	aborted  bool
+	grace    *time.Timer // resets the stream if it doesn't close in time
+}
+
+// run pings until the context is canceled.
+func (sess *session) run(ctx context.Context, out chan<- DetailedResult) {
+	ps := sess.ps
+	initialBackoff := sess.backoff
+	if initialBackoff == 0 {
+		initialBackoff = defaultReopenBackoff
+	}
+	backoff := initialBackoff
+
+	if ps.startDelay > 0 {
+		t := time.NewTimer(ps.startDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+
+	failed := false
+	resync := false // set when the stream was reset after a payload mismatch
+	// the stream of the last round
+	var prev network.Stream
+	for ctx.Err() == nil {
+		s := sess.currentStream()
+		if s == nil {
+			if failed {
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+			}
+			var err error
+			s, err = sess.open(ctx)
+			if err != nil {
+				failed = true
+				backoff *= 2
+				if backoff > maxReopenBackoff {
+					backoff = maxReopenBackoff
+				}
+				res := DetailedResult{Result: Result{Time: time.Now(), Error: err}}
+				sess.score(err)
+				ps.track(sess.st, sess.p, res.Result)
+				sess.heartbeat()
+				if !sess.emit(ctx, out, res) {
+					return
+				}
+				continue
+			}
+			if resync {
+				log.Debugf("resynced ping stream to %s", sess.p)
+				ps.metricsTracer.StreamReopened(sess.transport)
+				ps.countReopen(sess.st)
+				sess.streamEvent(StreamResynced, nil)
+				resync = false
+			} else if failed {
+				log.Debugf("reopened ping stream to %s", sess.p)
+				ps.metricsTracer.StreamReopened(sess.transport)
+				ps.countReopen(sess.st)
+				sess.streamEvent(StreamReopened, nil)
+			} else if sess.migrated {
+				log.Debugf("migrated ping stream to %s to a %s connection", sess.p, sess.transport)
+				sess.streamEvent(StreamMigrated, nil)
+			} else {
+				sess.streamEvent(StreamOpened, nil)
+			}
+		}
+
+		if ps.schedule > 0 {
+			t := time.NewTimer(time.Until(nextBoundary(time.Now(), ps.schedule)))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+
+		measure := sess.measureRound(s)
+		start := time.Now()
+		var res DetailedResult
+		var err error
+		// Only check streams that completed a round, the first read of a
+		// new stream may complete the protocol negotiation.
+		if s == prev && ps.rejectUnsolicited {
+			err = checkUnsolicited(s)
+		} else {
+			sess.streamSince = start
+		}
+		prev = s
+		mark := ps.overhead.begin()
+		if err == nil {
+			res, err = ps.pingWithTimeout(ctx, s, sess.rand, measure)
+		}
+		res.Time = start
+		res.Error = err
+		res.Dialed = sess.dialed
+		res.Migrated = sess.migrated
+		res.StreamOpen = sess.opened
+		res.Transport = sess.transport
+		res.Conn = sess.conn
+		res.Direction = s.Conn().Stat().Direction
+		sess.dialed = false
+		sess.migrated = false
+		sess.opened = 0
+
+		// canceled, ignore everything.
+		if ctx.Err() != nil {
+			return
+		}
+		if res.Error == nil && measure && sess.drop() {
+			res.RTT = 0
+			res.Error = &PingError{Peer: sess.p, Conn: s.Conn(), Op: "round", Err: fmt.Errorf("%w (simulated loss)", ErrRoundTimeout)}
+		}
+		if res.Error == nil && measure && ps.maxRTT > 0 && res.RTT > ps.maxRTT {
+			res.Error = &PingError{Peer: sess.p, Conn: s.Conn(), Op: "round", Err: fmt.Errorf("%w: %s > %s", ErrRTTExceeded, res.RTT, ps.maxRTT)}
+		}
+		if measure {
+			ps.traceRound(ctx, sess.p, start, res.Result)
+		}
+
+		// No error, record the RTT.
+		if res.Error == nil && !measure {
+			// keepalive round, only the stream lifecycle applies
+			failed = false
+			backoff = initialBackoff
+			sess.releaseStream(s)
+			sess.heartbeat()
+			continue
+		} else if res.Error == nil {
+			failed = false
+			backoff = initialBackoff
+			first := !sess.sampled
+			sess.sampled = true
+			// RTTs over transient connections (e.g. relayed ones) don't
+			// reflect the latency of a direct connection.
+			if ps.recordLatency && !(first && ps.skipFirstRecord) && !s.Conn().Stat().Transient && ps.plausible(sess.st, res.RTT) {
+				ps.Host.Peerstore().RecordLatency(sess.p, res.RTT)
+				res.Recorded = true
+			}
+			ps.metricsTracer.RoundCompleted(sess.transport, res.RTT)
+			if evt := ps.observe(sess.st, sess.p, res.RTT, res.Time, s.Conn()); evt != nil {
+				evt.Tag = sess.tag
+				evt.Transport = sess.transport
+				if err := ps.alertEmitter.Emit(*evt); err != nil {
+					log.Debugf("failed to emit ping alert: %s", err)
+				}
+			}
+			sess.releaseStream(s)
+		} else if sess.backoff > 0 || ps.freshStream || ps.rotateConns {
+			// The stream is broken, get a new one for the next round. After a
+			// payload mismatch, the stream is out of sync with the peer and
+			// every following round would fail as well.
+			failed = true
+			resync = errors.Is(res.Error, errPayloadMismatch)
+			s.Reset()
+			sess.setStream(nil)
+			sess.streamEvent(StreamReset, res.Error)
+		}
+
+		sess.score(res.Error)
+		ps.track(sess.st, sess.p, res.Result)
+		if measure && res.Error == nil {
+			ps.overhead.end(mark, res.WaitTime)
+		}
+		sess.heartbeat()
+		if !sess.emit(ctx, out, res) {
+			return
+		}
+	}
+}
+
+// releaseStream closes s after a successful round, unless the session reuses
+// it for the next round.
+func (sess *session) releaseStream(s network.Stream) {
+	ps := sess.ps
+	if c := sess.upgradedConn(s); c != nil {
+		// reported once the stream is replaced
+		sess.migrateTo = c
+		s.Close()
+		sess.setStream(nil)
+		return
+	}
+	kind := StreamClosed
+	if !ps.freshStream && !ps.rotateConns {
+		if ps.rotateInterval == 0 || time.Since(sess.streamSince) < ps.rotateInterval {
+			return
+		}
+		kind = StreamRotated
+	}
+	s.Close()
+	sess.setStream(nil)
+	sess.streamEvent(kind, nil)
+}
+
+// upgradedConn returns a direct connection to the peer to migrate s to, in
+// resilient mode, if s goes over a transient connection, e.g. a relayed one
+// that a hole punch since replaced. It returns nil otherwise. Looking the
+// connections up once per round catches upgrades without subscribing to
+// connection events, and costs nothing for streams that are already direct.
+func (sess *session) upgradedConn(s network.Stream) network.Conn {
+	if sess.backoff == 0 || !s.Conn().Stat().Transient {
+		return nil
+	}
+	for _, c := range sess.ps.Host.Network().ConnsToPeer(sess.p) {
+		if !c.Stat().Transient {
+			return c
+		}
+	}
+	return nil
+}
+
+// measureRound reports whether the next round over s is measured, as opposed
+// to an unmeasured keepalive round, see MeasureEvery.
+func (sess *session) measureRound(s network.Stream) bool {
+	ps := sess.ps
+	if ps.measureEvery <= 1 || ps.batchSize > 1 {
+		return true
+	}
+	switch s.Protocol() {
+	case TimestampExtID, TimestampID, SizedID:
+		return true
+	}
+	measure := sess.unmeasured == 0
+	sess.unmeasured = (sess.unmeasured + 1) % ps.measureEvery
+	return measure
+}
+
+// drop reports whether the latest round should be reported as lost, as set
+// with DropRate.
+func (sess *session) drop() bool {
+	if sess.ps.dropRate == 0 {
+		return false
+	}
+	if sess.drops == nil {
+		sess.drops = mrand.New(mrand.NewSource(dropSeed))
+	}
+	return sess.drops.Float64() < sess.ps.dropRate
+}
+
+// nextBoundary returns the first multiple of align in wall-clock time after
+// now, as set with Schedule.
+func nextBoundary(now time.Time, align time.Duration) time.Time {
+	return now.Truncate(align).Add(align)
+}
+
+// heartbeat signals that the session completed a loop iteration.
+func (sess *session) heartbeat() {
+	if sess.ps.heartbeat != nil {
+		sess.ps.heartbeat()
+	}
+}
+
+// score reports the outcome of an attempt to the ScoreReporter, if set.
+func (sess *session) score(err error) {
+	if f := sess.ps.scoreReporter; f != nil {
+		if err != nil {
+			f(sess.p, -1)
+		} else {
+			f(sess.p, 1)
+		}
+	}
+}
+
+// emit delivers a result to the consumer, and reports whether the session
+// should continue.
+func (sess *session) emit(ctx context.Context, out chan<- DetailedResult, res DetailedResult) bool {
+	res.Tag = sess.tag
+	if res.Error != nil {
+		res.ConnEvent = sess.connEvents.last(time.Now())
+	}
+	if sess.ps.errorDedup > 0 && sess.ps.suppressError(sess.st, res.Error != nil, time.Now()) {
+		return true
+	}
+	if sess.ps.onResult != nil {
+		sess.ps.onResult(sess.p, res.Result)
+	}
+
+	select {
+	case out <- res:
+	case <-ctx.Done():
+		return false
+	}
+	sess.rounds++
+	if sess.ps.continueFunc != nil {
+		sess.acc.add(res.Result)
+		if !sess.ps.continueFunc(sess.acc.stats()) {
+			return false
+		}
+	}
+	return sess.ps.count == 0 || sess.rounds < sess.ps.count
+}
+
+// open opens a new stream for the session, replacing the current one.
+func (sess *session) open(ctx context.Context) (network.Stream, error) {
+	start := time.Now()
+	var s network.Stream
+	var dialed bool
+	var err error
+	c := sess.migrateTo
+	sess.migrateTo = nil
+	sess.migrated = c != nil
+	if c == nil {
+		c = sess.nextConn()
+	}
+	if c != nil {
+		s, err = sess.ps.openStreamOn(ctx, c)
+		if err != nil {
+			err = &PingError{Peer: sess.p, Conn: c, Op: "open", Err: err}
+		}
+	} else {
+		s, dialed, err = sess.ps.openStream(ctx, sess.p)
+	}
+	if err != nil {
+		sess.ps.debugf(sess.p, "failed to open ping stream to %s: %s", sess.p, err)
+		return nil, err
+	}
+	s = &countingStream{Stream: s, st: sess.st}
+	if !sess.setStream(s) {
+		return nil, ctx.Err()
+	}
+	sess.dialed = dialed
+	sess.opened = time.Since(start)
+	sess.transport = transportName(s.Conn().RemoteMultiaddr())
+	sess.conn = s.Conn().ID()
+	sess.ps.metricsTracer.StreamOpenTime(sess.transport, sess.opened)
+	return s, nil
+}
+
+// nextConn returns the connection to the peer following the one the last
+// stream was opened on, with the RotateConnections option. It returns nil if
+// connections aren't rotated, or if there's a single connection to the peer.
+func (sess *session) nextConn() network.Conn {
+	if !sess.ps.rotateConns {
+		return nil
+	}
+	conns := sess.ps.Host.Network().ConnsToPeer(sess.p)
+	if len(conns) < 2 {
+		return nil
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID() < conns[j].ID() })
+	for i, c := range conns {
+		if c.ID() > sess.conn {
+			return conns[i]
+		}
+	}
+	return conns[0]
+}
+
+func (sess *session) currentStream() network.Stream {
+	sess.streamMx.Lock()
+	defer sess.streamMx.Unlock()
+	return sess.stream
+}
+
+// setStream replaces the current stream. It resets s and returns false if the
+// session was already aborted.
+func (sess *session) setStream(s network.Stream) bool {
+	sess.streamMx.Lock()
+	defer sess.streamMx.Unlock()
+
+	if sess.aborted {
+		if s != nil {
+			s.Reset()
+		}
+		return false
+	}
+	sess.stream = s
+	return true
+}
+
+// abort ends the current stream when the session is canceled. Unless the
+// ResetOnCancel option is set, the stream is closed for writing, so that the
+// peer sees a clean close, and only reset if a round in progress doesn't
+// complete within closeGrace.
+func (sess *session) abort() {
+	sess.streamMx.Lock()
+	defer sess.streamMx.Unlock()
+
+	sess.aborted = true
+	if sess.stream == nil {
+		return
+	}
+	if sess.ps.resetOnCancel {
+		sess.stream.Reset()
+		return
+	}
+	s := sess.stream
+	s.CloseWrite()
+	sess.grace = time.AfterFunc(closeGrace, func() { s.Reset() })
+}
+
+// closeStream closes the stream of a session that ended, unless abort reset
+// it.
+func (sess *session) closeStream() {
+	sess.streamMx.Lock()
+	defer sess.streamMx.Unlock()
+
+	if sess.stream != nil && sess.grace != nil && sess.grace.Stop() {
+		sess.stream.Close()
+	}
+}
+
+// roundTimeout returns the timeout of the next outbound round. Unless set
+// explicitly, it is capped to the time remaining until the context deadline,
+// in which case deadline is set.
+func (ps *PingService) roundTimeout(ctx context.Context) (timeout time.Duration, deadline bool) {
+	timeout = ps.timeout
+	if !ps.timeoutSet {
+		if d, ok := ctx.Deadline(); ok {
+			if remaining := time.Until(d); remaining < timeout {
+				return remaining, true
+			}
+		}
+	}
+	return timeout, false
+}
+
+// classifyTimeout tells whether a round that timed out over c did so because
+// the stream is dead or because the echo is slow, see ErrEchoSlow.
+func (ps *PingService) classifyTimeout(ctx context.Context, c network.Conn) error {
+	if !ps.connOpen(c) {
+		return ErrStreamDead
+	}
+	if ps.livenessProbe > 0 && !ps.probeConn(ctx, c) {
+		return ErrStreamDead
+	}
+	return ErrEchoSlow
+}
+
+// connOpen reports whether c is still among the open connections of the host.
+func (ps *PingService) connOpen(c network.Conn) bool {
+	for _, open := range ps.Host.Network().ConnsToPeer(c.RemotePeer()) {
+		if open.ID() == c.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// probeConn reports whether a keepalive round over a new stream on c
+// completes within the liveness probe timeout.
+func (ps *PingService) probeConn(ctx context.Context, c network.Conn) bool {
+	ctx, cancel := context.WithTimeout(ctx, ps.livenessProbe)
+	defer cancel()
+	s, err := ps.openStreamWith(ctx, c, []protocol.ID{KeepaliveID, ID})
+	if err != nil {
+		ps.debugf(c.RemotePeer(), "liveness probe of %s failed: %s", c.RemotePeer(), err)
+		return false
+	}
+	t := time.AfterFunc(ps.livenessProbe, func() { s.Reset() })
+	err = ps.keepalive(s)
+	if !t.Stop() || err != nil {
+		ps.debugf(c.RemotePeer(), "liveness probe of %s failed: %s", c.RemotePeer(), err)
+		s.Reset()
+		return false
+	}
+	s.Close()
+	return true
+}
+
+// checkUnsolicited checks that the peer didn't send data on s since the last
+// round, as such data would be mistaken for the echo of the next round. The
+// stream is reset if it did. It relies on read deadlines, streams not
+// supporting them aren't checked.
+func checkUnsolicited(s network.Stream) error {
+	// Some muxers fail reads with an expired deadline even if data is
+	// buffered, so give the read a moment.
+	if err := s.SetReadDeadline(time.Now().Add(unsolicitedWait)); err != nil {
+		return nil
+	}
+	var b [1]byte
+	n, err := s.Read(b[:])
+	s.SetReadDeadline(time.Time{})
+	switch {
+	case n > 0:
+		err = ErrUnsolicitedData
+	case err == nil:
+		return nil
+	default:
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil
+		}
+	}
+	s.Reset()
+	return &PingError{Peer: s.Conn().RemotePeer(), Conn: s.Conn(), Op: "round", Err: err}
+}
+
+// pingWithTimeout performs a ping round over s, or a keepalive round unless
+// measure is set, resetting the stream if the round doesn't complete within
+// the round timeout.
+func (ps *PingService) pingWithTimeout(ctx context.Context, s network.Stream, randReader io.Reader, measure bool) (DetailedResult, error) {
+	timeout, deadline := ps.roundTimeout(ctx)
+	t := time.AfterFunc(timeout, func() { s.Reset() })
+	var res DetailedResult
+	var err error
+	if measure {
+		res, err = ps.ping(s, randReader)
+	} else {
+		err = ps.keepalive(s)
+	}
+	// Once the timer fired, the stream is reset even if the round completed
+	// in the meantime.
+	if !t.Stop() {
+		if deadline {
+			// The context is about to expire, report it as such so that
+			// callers treat the round as canceled.
+			<-ctx.Done()
+			return res, ctx.Err()
+		}
+		err = fmt.Errorf("%w after %s", ps.classifyTimeout(ctx, s.Conn()), timeout)
+	}
+	if err != nil {
+		op := "round"
+		if !measure {
+			op = "keepalive"
+		}
+		err = &PingError{Peer: s.Conn().RemotePeer(), Conn: s.Conn(), Op: op, Err: err}
+	}
+	return res, err
+}
+
+func (ps *PingService) ping(s network.Stream, randReader io.Reader) (DetailedResult, error) {
+	switch s.Protocol() {
+	case TimestampExtID:
+		return ps.pingTimestamped(s, randReader, true)
+	case TimestampID:
+		return ps.pingTimestamped(s, randReader, false)
+	case SizedID:
+		return ps.pingSized(s, randReader, ps.payloadSize)
+	}
+	if ps.batchSize > 1 {
+		return ps.pingBatch(s, randReader)
+	}
+
+	if err := s.Scope().ReserveMemory(2*PingSize, ps.reservePriority); err != nil {
+		log.Debugf("error reserving memory for ping stream: %s", err)
+		s.Reset()
+		return DetailedResult{}, err
+	}
+	defer s.Scope().ReleaseMemory(2 * PingSize)
+
+	buf := ps.getBuf(PingSize)
+	defer ps.putBuf(buf)
+	rbuf := ps.getBuf(PingSize)
+	defer ps.putBuf(rbuf)
+	return ps.pingPayload(s, randReader, buf, rbuf)
+}
+
+// pingPayload performs a ping round over s with a payload of len(buf) bytes,
+// reading the echo into rbuf.
+func (ps *PingService) pingPayload(s RawStream, randReader io.Reader, buf, rbuf []byte) (DetailedResult, error) {
+	var res DetailedResult
+	if _, err := io.ReadFull(randReader, buf); err != nil {
+		return res, err
+	}
+
+	seq := ps.wireSeqs(1)
+	before := time.Now()
+	if err := writeFull(s, buf); err != nil {
+		return res, err
+	}
+	written := time.Now()
+	ps.wireEvent(s, seq, WireWrite, written)
+	res.WriteTime = written.Sub(before)
+
+	if _, err := io.ReadFull(s, rbuf); err != nil {
+		return res, err
+	}
+	received := time.Now()
+	ps.wireEvent(s, seq, WireRead, received)
+	res.WaitTime = received.Sub(written)
+
+	ps.keepPayloads(s, buf, rbuf)
+	if err := ps.verify(buf, rbuf); err != nil {
+		return res, err
+	}
+	res.RTT = received.Sub(before)
+
+	if ps.measureLocalDelay {
+		// Yield and measure how long it takes until we get to run again. On an
+		// overloaded node this is dominated by the run queue, not the network.
+		runtime.Gosched()
+		res.SchedDelay = time.Since(received)
+	}
+
+	return res, nil
+}
+
+// keepalive echoes a zero payload over s, without timing the round or
+// checking the echo. The payload is a single byte on KeepaliveID streams.
+func (ps *PingService) keepalive(s network.Stream) error {
+	size := PingSize
+	if s.Protocol() == KeepaliveID {
+		size = 1
+	}
+	if err := s.Scope().ReserveMemory(size, ps.reservePriority); err != nil {
+		log.Debugf("error reserving memory for ping stream: %s", err)
+		s.Reset()
+		return err
+	}
+	defer s.Scope().ReleaseMemory(size)
+
+	buf := ps.getBuf(size)
+	defer ps.putBuf(buf)
+	for i := range buf {
+		buf[i] = 0
+	}
+	if err := writeFull(s, buf); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(s, buf)
+	return err
+}
+
+// pingBatch writes batchSize payloads back to back before reading their echoes,
+// and reports the average RTT of the payloads.
+func (ps *PingService) pingBatch(s network.Stream, randReader io.Reader) (DetailedResult, error) {
+	var res DetailedResult
+	size := ps.batchSize * PingSize
+	if err := s.Scope().ReserveMemory(2*size, ps.reservePriority); err != nil {
+		log.Debugf("error reserving memory for ping stream: %s", err)
+		s.Reset()
+		return res, err
+	}
+	defer s.Scope().ReleaseMemory(2 * size)
+
+	buf := ps.getBuf(size)
+	defer ps.putBuf(buf)
+
+	if _, err := io.ReadFull(randReader, buf); err != nil {
+		return res, err
+	}
+
+	// Write from a separate goroutine, so that we keep reading echoes even if
+	// the stream can't buffer the whole batch.
+	sent := make(chan time.Time, ps.batchSize)
+	writeDone := make(chan error, 1)
+	var written time.Time
+	seq := ps.wireSeqs(ps.batchSize)
+	go func() {
+		for i := 0; i < ps.batchSize; i++ {
+			sent <- time.Now()
+			if err := writeFull(s, buf[i*PingSize:(i+1)*PingSize]); err != nil {
+				writeDone <- err
+				return
+			}
+			ps.wireEvent(s, seq+uint64(i), WireWrite, time.Now())
+		}
+		written = time.Now()
+		writeDone <- nil
+	}()
+
+	rbuf := ps.getBuf(PingSize)
+	defer ps.putBuf(rbuf)
+
+	var total time.Duration
+	var first, received time.Time
+	for i := 0; i < ps.batchSize; i++ {
+		_, err := io.ReadFull(s, rbuf)
+		if err == nil {
+			ps.keepPayloads(s, buf[i*PingSize:(i+1)*PingSize], rbuf)
+			err = ps.verify(buf[i*PingSize:(i+1)*PingSize], rbuf)
+		}
+		if err != nil {
+			// The rest of the batch can't be matched anymore. Reset the stream
+			// to unblock the writer.
+			s.Reset()
+			<-writeDone
+			return res, err
+		}
+		received = time.Now()
+		ps.wireEvent(s, seq+uint64(i), WireRead, received)
+		sentAt := <-sent
+		if i == 0 {
+			first = sentAt
+		}
+		total += received.Sub(sentAt)
+	}
+	if err := <-writeDone; err != nil {
+		return res, err
+	}
+	res.WriteTime = written.Sub(first)
+	res.WaitTime = received.Sub(written)
+	res.RTT = total / time.Duration(ps.batchSize)
+
+	if ps.measureLocalDelay {
+		runtime.Gosched()
+		res.SchedDelay = time.Since(received)
+	}
+
+	return res, nil
+}
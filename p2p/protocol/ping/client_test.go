@@ -0,0 +1,330 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/stretchr/testify/require"
+)
+
+type connsHost struct {
+	host.Host
+	net *connsNetwork
+}
+
+func (h *connsHost) Network() network.Network { return h.net }
+
+type connsNetwork struct {
+	network.Network
+	conns []network.Conn
+}
+
+func (n *connsNetwork) ConnsToPeer(peer.ID) []network.Conn {
+	return append([]network.Conn(nil), n.conns...)
+}
+
+type idConn struct {
+	network.Conn
+	id string
+}
+
+func (c *idConn) ID() string { return c.id }
+
+func TestNextConn(t *testing.T) {
+	net := &connsNetwork{conns: []network.Conn{&idConn{id: "c"}, &idConn{id: "a"}}}
+	ps := newPingService(&connsHost{net: net})
+	sess := &session{ps: ps, p: "peer"}
+	require.Nil(t, sess.nextConn())
+
+	ps.rotateConns = true
+	sess.conn = "b"
+	require.Equal(t, "c", sess.nextConn().ID())
+	sess.conn = "c"
+	require.Equal(t, "a", sess.nextConn().ID())
+	sess.conn = "a"
+	require.Equal(t, "c", sess.nextConn().ID())
+
+	// a single connection isn't rotated
+	net.conns = net.conns[:1]
+	require.Nil(t, sess.nextConn())
+}
+
+type noDelayStream struct {
+	network.Stream
+	noDelay bool
+}
+
+func (s *noDelayStream) SetNoDelay(noDelay bool) error {
+	s.noDelay = noDelay
+	return nil
+}
+
+func TestSetNoDelay(t *testing.T) {
+	s := &noDelayStream{}
+	setNoDelay(s)
+	require.True(t, s.noDelay)
+}
+
+type prioScope struct {
+	network.StreamScope
+	prio uint8
+}
+
+func (s *prioScope) ReserveMemory(_ int, prio uint8) error {
+	s.prio = prio
+	return errors.New("out of memory")
+}
+
+type prioStream struct {
+	network.Stream
+	scope *prioScope
+}
+
+func (s *prioStream) Scope() network.StreamScope { return s.scope }
+func (s *prioStream) Protocol() protocol.ID      { return ID }
+func (s *prioStream) Reset() error               { return nil }
+
+func TestReservationPriority(t *testing.T) {
+	ps := newPingService(nil)
+	s := &prioStream{scope: &prioScope{}}
+	_, err := ps.ping(s, nil)
+	require.Error(t, err)
+	require.Equal(t, network.ReservationPriorityAlways, s.scope.prio)
+
+	require.NoError(t, ReservationPriority(network.ReservationPriorityLow)(ps))
+	_, err = ps.ping(s, nil)
+	require.Error(t, err)
+	require.Equal(t, network.ReservationPriorityLow, s.scope.prio)
+}
+
+func TestRoundTimeout(t *testing.T) {
+	ps := newPingService(nil)
+	timeout, deadline := ps.roundTimeout(context.Background())
+	require.Equal(t, defaultTimeout, timeout)
+	require.False(t, deadline)
+
+	far, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	timeout, deadline = ps.roundTimeout(far)
+	require.Equal(t, defaultTimeout, timeout)
+	require.False(t, deadline)
+
+	near, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	timeout, deadline = ps.roundTimeout(near)
+	require.LessOrEqual(t, timeout, time.Second)
+	require.Greater(t, timeout, 500*time.Millisecond)
+	require.True(t, deadline)
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	timeout, deadline = ps.roundTimeout(expired)
+	require.LessOrEqual(t, timeout, time.Duration(0))
+	require.True(t, deadline)
+
+	// an explicit timeout isn't derived from the deadline
+	require.NoError(t, Timeout(time.Minute)(ps))
+	timeout, deadline = ps.roundTimeout(near)
+	require.Equal(t, time.Minute, timeout)
+	require.False(t, deadline)
+}
+
+func TestNextBoundary(t *testing.T) {
+	base := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, base.Add(10*time.Second), nextBoundary(base.Add(3*time.Second), 10*time.Second))
+	require.Equal(t, base.Add(10*time.Second), nextBoundary(base.Add(9999*time.Millisecond), 10*time.Second))
+	// a time on a boundary waits for the next one
+	require.Equal(t, base.Add(10*time.Second), nextBoundary(base, 10*time.Second))
+	require.Equal(t, base.Add(time.Minute), nextBoundary(base.Add(59*time.Second), time.Minute))
+}
+
+type nopScope struct{ network.StreamScope }
+
+func (nopScope) ReserveMemory(int, uint8) error { return nil }
+func (nopScope) ReleaseMemory(int)              {}
+
+// shortStream echoes what is written to it, accepting at most max bytes per
+// write.
+type shortStream struct {
+	network.Stream
+	max int
+	buf bytes.Buffer
+}
+
+func (s *shortStream) Scope() network.StreamScope { return nopScope{} }
+func (s *shortStream) Protocol() protocol.ID      { return ID }
+func (s *shortStream) Read(b []byte) (int, error) { return s.buf.Read(b) }
+func (s *shortStream) Write(b []byte) (int, error) {
+	if len(b) > s.max {
+		b = b[:s.max]
+	}
+	return s.buf.Write(b)
+}
+
+func TestWriteFull(t *testing.T) {
+	s := &shortStream{max: 5}
+	require.NoError(t, writeFull(s, bytes.Repeat([]byte{1}, 32)))
+	require.Equal(t, 32, s.buf.Len())
+
+	// writes making no progress
+	s = &shortStream{max: 0}
+	require.ErrorIs(t, writeFull(s, []byte{1}), io.ErrShortWrite)
+}
+
+func TestPingShortWrites(t *testing.T) {
+	ps := newPingService(nil)
+	ra, err := newRand()
+	require.NoError(t, err)
+	_, err = ps.ping(&shortStream{max: 7}, ra)
+	require.NoError(t, err)
+
+	// the handler's echo
+	payload := bytes.Repeat([]byte{42}, PingSize)
+	s := &shortStream{max: 3}
+	s.buf.Write(payload)
+	require.NoError(t, ps.echo(s, make([]byte, PingSize), nil))
+	require.Equal(t, payload, s.buf.Bytes())
+}
+
+type stallConn struct {
+	network.Conn
+	id string
+}
+
+func (c *stallConn) ID() string          { return c.id }
+func (c *stallConn) RemotePeer() peer.ID { return "peer" }
+func (c *stallConn) NewStream(context.Context) (network.Stream, error) {
+	return nil, errors.New("no streams")
+}
+
+// stallStream never echoes, its reads blocking until it is reset.
+type stallStream struct {
+	network.Stream
+	conn  network.Conn
+	reset chan struct{}
+	once  sync.Once
+}
+
+func newStallStream(c network.Conn) *stallStream {
+	return &stallStream{conn: c, reset: make(chan struct{})}
+}
+
+func (s *stallStream) Scope() network.StreamScope  { return nopScope{} }
+func (s *stallStream) Protocol() protocol.ID       { return ID }
+func (s *stallStream) Conn() network.Conn          { return s.conn }
+func (s *stallStream) Write(b []byte) (int, error) { return len(b), nil }
+func (s *stallStream) Read([]byte) (int, error) {
+	<-s.reset
+	return 0, network.ErrReset
+}
+func (s *stallStream) Reset() error {
+	s.once.Do(func() { close(s.reset) })
+	return nil
+}
+
+func TestTimeoutClassification(t *testing.T) {
+	conn := &stallConn{id: "conn"}
+	net := &connsNetwork{conns: []network.Conn{conn}}
+	ps := newPingService(&connsHost{net: net})
+	require.NoError(t, Timeout(50*time.Millisecond)(ps))
+	ra, err := newRand()
+	require.NoError(t, err)
+
+	// the connection is still open
+	_, err = ps.pingWithTimeout(context.Background(), newStallStream(conn), ra, true)
+	require.ErrorIs(t, err, ErrEchoSlow)
+	require.ErrorIs(t, err, ErrRoundTimeout)
+
+	// the connection isn't open anymore
+	net.conns = nil
+	_, err = ps.pingWithTimeout(context.Background(), newStallStream(conn), ra, true)
+	require.ErrorIs(t, err, ErrStreamDead)
+	require.ErrorIs(t, err, ErrRoundTimeout)
+
+	// the connection is open, but the probe fails
+	net.conns = []network.Conn{conn}
+	require.NoError(t, LivenessProbe(50*time.Millisecond)(ps))
+	_, err = ps.pingWithTimeout(context.Background(), newStallStream(conn), ra, true)
+	require.ErrorIs(t, err, ErrStreamDead)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	payload := bytes.Repeat([]byte{7}, 64)
+	seal(payload)
+	echo := append([]byte(nil), payload...)
+	require.NoError(t, verifyChecksum(payload, echo))
+
+	// a corrupted echo
+	echo[3] ^= 1
+	require.ErrorIs(t, verifyChecksum(payload, echo), errPayloadMismatch)
+
+	// the consistent echo of another payload
+	other := bytes.Repeat([]byte{8}, 64)
+	seal(other)
+	require.ErrorIs(t, verifyChecksum(payload, other), errPayloadMismatch)
+	require.ErrorIs(t, verifyChecksum(payload, other[:32]), errPayloadMismatch)
+}
+
+type statConn struct {
+	network.Conn
+	id        string
+	transient bool
+}
+
+func (c *statConn) ID() string { return c.id }
+func (c *statConn) Stat() network.ConnStats {
+	return network.ConnStats{Stats: network.Stats{Transient: c.transient}}
+}
+
+type connStream struct {
+	network.Stream
+	conn   network.Conn
+	closed bool
+}
+
+func (s *connStream) Conn() network.Conn { return s.conn }
+func (s *connStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestMigrateToDirectConn(t *testing.T) {
+	relayed := &statConn{id: "relayed", transient: true}
+	net := &connsNetwork{conns: []network.Conn{relayed}}
+	ps := newPingService(&connsHost{net: net})
+	sess := &session{ps: ps, p: "peer"}
+
+	// outside of resilient mode
+	direct := &statConn{id: "direct"}
+	net.conns = append(net.conns, direct)
+	require.Nil(t, sess.upgradedConn(&connStream{conn: relayed}))
+
+	// in resilient mode
+	sess.backoff = time.Second
+	require.Nil(t, sess.upgradedConn(&connStream{conn: direct}), "direct streams stay")
+	s := &connStream{conn: relayed}
+	sess.stream = s
+	sess.releaseStream(s)
+	require.True(t, s.closed)
+	require.Nil(t, sess.currentStream())
+	require.Equal(t, direct, sess.migrateTo)
+
+	// no direct connection yet
+	sess = &session{ps: ps, p: "peer", backoff: time.Second}
+	net.conns = net.conns[:1]
+	s = &connStream{conn: relayed}
+	sess.stream = s
+	sess.releaseStream(s)
+	require.False(t, s.closed)
+	require.Equal(t, s, sess.currentStream())
+}
@@ -0,0 +1,91 @@
+package ping
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// number of connection events kept by a session
+const connEventRing = 8
+
+// ConnEventKind is the kind of a connection event, see ConnEvent.
+type ConnEventKind int
+
+const (
+	// ConnOpened is reported when a connection to the peer was established.
+	ConnOpened ConnEventKind = iota
+	// ConnClosed is reported when a connection to the peer was closed.
+	ConnClosed
+)
+
+func (k ConnEventKind) String() string {
+	switch k {
+	case ConnOpened:
+		return "opened"
+	case ConnClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnEvent is a connection to the peer being opened or closed during a ping
+// session, as attached to failed Results to help explain the failure.
+type ConnEvent struct {
+	Kind ConnEventKind
+	Time time.Time
+	// Conn is the ID of the connection, and Transport its transport as
+	// reported in Result.
+	Conn, Transport string
+	// Before is how long before the failure the event happened.
+	Before time.Duration
+}
+
+func (e ConnEvent) String() string {
+	return fmt.Sprintf("%s connection %s %s %s before the failure", e.Transport, e.Conn, e.Kind, e.Before)
+}
+
+// connEvents keeps the recent connection events to the peer of a session.
+type connEvents struct {
+	mx     sync.Mutex
+	events []ConnEvent // oldest first
+}
+
+// notifee returns a notifee recording the connection events to p.
+func (e *connEvents) notifee(p peer.ID) network.Notifiee {
+	record := func(kind ConnEventKind, c network.Conn) {
+		if c.RemotePeer() == p {
+			e.add(ConnEvent{Kind: kind, Time: time.Now(), Conn: c.ID(), Transport: transportName(c.RemoteMultiaddr())})
+		}
+	}
+	return &network.NotifyBundle{
+		ConnectedF:    func(_ network.Network, c network.Conn) { record(ConnOpened, c) },
+		DisconnectedF: func(_ network.Network, c network.Conn) { record(ConnClosed, c) },
+	}
+}
+
+func (e *connEvents) add(ev ConnEvent) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if len(e.events) == connEventRing {
+		e.events = append(e.events[:0], e.events[1:]...)
+	}
+	e.events = append(e.events, ev)
+}
+
+// last returns the most recent event that happened before t, if any.
+func (e *connEvents) last(t time.Time) *ConnEvent {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	for i := len(e.events) - 1; i >= 0; i-- {
+		if ev := e.events[i]; !ev.Time.After(t) {
+			ev.Before = t.Sub(ev.Time)
+			return &ev
+		}
+	}
+	return nil
+}
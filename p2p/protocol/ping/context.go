@@ -0,0 +1,51 @@
+package ping
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+type sessionTagCtxKey struct{}
+
+var sessionTag = sessionTagCtxKey{}
+
+// WithSessionTag constructs a new context carrying an arbitrary tag for the
+// ping session started with it. The tag is reported in every Result of the
+// session, allowing a single OnResult callback to route results to the
+// correct consumer.
+func WithSessionTag(ctx context.Context, tag any) context.Context {
+	return context.WithValue(ctx, sessionTag, tag)
+}
+
+// GetSessionTag returns the session tag set in the context, or nil if none
+// was set.
+func GetSessionTag(ctx context.Context) any {
+	return ctx.Value(sessionTag)
+}
+
+// UnreachableContext returns a context that is canceled once failThreshold
+// consecutive pings to p failed, for work that depends on p being reachable.
+// It pings p with a session of its own until then, or until parent is done,
+// which ends the session. The context is canceled as well if the session
+// ends on its own, e.g. because of the Count option. Thresholds below 1 are
+// treated as 1.
+func (ps *PingService) UnreachableContext(parent context.Context, p peer.ID, failThreshold int) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		defer cancel()
+		failures := 0
+		for res := range ps.Ping(ctx, p) {
+			if res.Error == nil {
+				failures = 0
+				continue
+			}
+			failures++
+			if failures >= failThreshold {
+				log.Debugf("%s unreachable after %d failed pings: %s", p, failures, res.Error)
+				return
+			}
+		}
+	}()
+	return ctx
+}
@@ -0,0 +1,53 @@
+package ping
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// csvHeader lists the columns written by WriteCSV.
+var csvHeader = []string{"peer", "sent", "received", "loss", "min", "mean", "max", "stddev", "p95", "p99"}
+
+// WriteCSV writes stats to w as CSV, with a header line and one line per
+// peer, ordered by peer ID. Durations are written in nanoseconds, and the
+// loss as a fraction from 0 to 1. Empty stats yield the header only.
+func WriteCSV(w io.Writer, stats map[peer.ID]Statistics) error {
+	peers := make([]peer.ID, 0, len(stats))
+	for p := range stats {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, p := range peers {
+		st := stats[p]
+		if err := cw.Write([]string{
+			p.String(),
+			strconv.Itoa(st.Sent),
+			strconv.Itoa(st.Received),
+			strconv.FormatFloat(st.Loss, 'g', -1, 64),
+			formatNanos(st.Min),
+			formatNanos(st.Mean),
+			formatNanos(st.Max),
+			formatNanos(st.StdDev),
+			formatNanos(st.P95),
+			formatNanos(st.P99),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatNanos(d time.Duration) string {
+	return strconv.FormatInt(int64(d), 10)
+}
@@ -0,0 +1,32 @@
+package ping_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, ping.WriteCSV(&buf, nil))
+	require.Equal(t, "peer,sent,received,loss,min,mean,max,stddev,p95,p99\n", buf.String())
+
+	a, b := peer.ID("a"), peer.ID("b")
+	buf.Reset()
+	require.NoError(t, ping.WriteCSV(&buf, map[peer.ID]ping.Statistics{
+		b: {Sent: 4, Received: 2, Loss: 0.5},
+		a: {
+			Sent: 2, Received: 2,
+			Min: time.Millisecond, Mean: 2 * time.Millisecond, Max: 3 * time.Millisecond,
+			StdDev: time.Millisecond, P95: 3 * time.Millisecond, P99: 3 * time.Millisecond,
+		},
+	}))
+	require.Equal(t, "peer,sent,received,loss,min,mean,max,stddev,p95,p99\n"+
+		a.String()+",2,2,0,1000000,2000000,3000000,1000000,3000000,3000000\n"+
+		b.String()+",4,2,0.5,0,0,0,0,0,0\n", buf.String())
+}
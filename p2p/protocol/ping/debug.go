@@ -0,0 +1,76 @@
+package ping
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// debugPeer is the live state of a peer reported by ServeDebug.
+type debugPeer struct {
+	Peer        string `json:"peer"`
+	Sessions    int    `json:"sessions"`
+	SmoothedRTT string `json:"smoothed_rtt,omitempty"`
+	Alert       string `json:"alert"`
+	// fraction of failed attempts since the first active session started
+	Loss     float64 `json:"loss"`
+	Attempts int     `json:"attempts"`
+
+	LastTime  *time.Time `json:"last_time,omitempty"`
+	LastRTT   string     `json:"last_rtt,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// ServeDebug returns a read-only HTTP handler reporting the live state of the
+// peers there are active outbound ping sessions to as JSON: the number of
+// sessions, the smoothed RTT and alert level, the loss and the last sample.
+// Applications can mount it on their debug mux. Peers are listed by ID.
+func (ps *PingService) ServeDebug() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		peers := ps.debugPeers()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Peers []debugPeer `json:"peers"`
+		}{peers}); err != nil {
+			log.Debugf("failed to write ping debug state: %s", err)
+		}
+	})
+}
+
+func (ps *PingService) debugPeers() []debugPeer {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	peers := make([]debugPeer, 0, len(ps.peers))
+	for p, st := range ps.peers {
+		d := debugPeer{
+			Peer:     p.String(),
+			Sessions: st.sessions,
+			Alert:    st.alert.String(),
+			Attempts: st.attempts,
+		}
+		if st.smoothed > 0 {
+			d.SmoothedRTT = st.smoothed.String()
+		}
+		if st.attempts > 0 {
+			d.Loss = float64(st.failures) / float64(st.attempts)
+			t := st.last.Time
+			d.LastTime = &t
+			if st.last.Error != nil {
+				d.LastError = st.last.Error.Error()
+			} else {
+				d.LastRTT = st.last.RTT.String()
+			}
+		}
+		peers = append(peers, d)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Peer < peers[j].Peer })
+	return peers
+}
@@ -0,0 +1,68 @@
+package ping_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping/pingtest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeDebug(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	ps := ping.NewPingService(a)
+	handler := ps.ServeDebug()
+
+	type state struct {
+		Peers []struct {
+			Peer        string  `json:"peer"`
+			Sessions    int     `json:"sessions"`
+			SmoothedRTT string  `json:"smoothed_rtt"`
+			Loss        float64 `json:"loss"`
+			Attempts    int     `json:"attempts"`
+			LastRTT     string  `json:"last_rtt"`
+		} `json:"peers"`
+	}
+	get := func() state {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var st state
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st))
+		return st
+	}
+	require.Empty(t, get().Peers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := ps.Ping(ctx, b.ID())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, (<-results).Error)
+	}
+
+	st := get()
+	require.Len(t, st.Peers, 1)
+	p := st.Peers[0]
+	require.Equal(t, b.ID().String(), p.Peer)
+	require.Equal(t, 1, p.Sessions)
+	require.GreaterOrEqual(t, p.Attempts, 3)
+	require.Zero(t, p.Loss)
+	require.NotEmpty(t, p.SmoothedRTT)
+	require.NotEmpty(t, p.LastRTT)
+
+	// read-only
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	cancel()
+	for range results {
+	}
+	require.Empty(t, get().Peers)
+}
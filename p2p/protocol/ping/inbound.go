@@ -0,0 +1,134 @@
+package ping
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// stormDetector tracks the rate at which peers open inbound ping streams, and
+// puts peers opening too many streams in a short window into a cooldown.
+type stormDetector struct {
+	threshold int
+	window    time.Duration
+
+	mx        sync.Mutex
+	peers     map[peer.ID]*stormState
+	lastSweep time.Time
+}
+
+type stormState struct {
+	opens        []time.Time
+	blockedUntil time.Time
+}
+
+func newStormDetector(threshold int, window time.Duration) *stormDetector {
+	return &stormDetector{
+		threshold: threshold,
+		window:    window,
+		peers:     make(map[peer.ID]*stormState),
+	}
+}
+
+// allow records a new stream from p and reports whether it should be served.
+func (d *stormDetector) allow(p peer.ID, now time.Time) bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if now.Sub(d.lastSweep) > d.window {
+		d.sweep(now)
+	}
+
+	st, ok := d.peers[p]
+	if !ok {
+		st = &stormState{}
+		d.peers[p] = st
+	}
+	if now.Before(st.blockedUntil) {
+		return false
+	}
+
+	st.opens = append(pruneBefore(st.opens, now.Add(-d.window)), now)
+	if len(st.opens) > d.threshold {
+		st.opens = st.opens[:0]
+		st.blockedUntil = now.Add(d.window)
+		return false
+	}
+	return true
+}
+
+// sweep removes the state of peers that haven't opened a stream recently.
+func (d *stormDetector) sweep(now time.Time) {
+	d.lastSweep = now
+	for p, st := range d.peers {
+		st.opens = pruneBefore(st.opens, now.Add(-d.window))
+		if len(st.opens) == 0 && !now.Before(st.blockedUntil) {
+			delete(d.peers, p)
+		}
+	}
+}
+
+// peerLimiter limits the number of distinct peers served within a rolling
+// window. A peer counts towards the limit until window elapsed since it was
+// last served.
+type peerLimiter struct {
+	max    int
+	window time.Duration
+
+	mx   sync.Mutex
+	seen map[peer.ID]time.Time // last time each peer was served
+}
+
+func newPeerLimiter(max int, window time.Duration) *peerLimiter {
+	return &peerLimiter{
+		max:    max,
+		window: window,
+		seen:   make(map[peer.ID]time.Time),
+	}
+}
+
+// allow records a new stream from p and reports whether it should be served.
+func (l *peerLimiter) allow(p peer.ID, now time.Time) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if _, ok := l.seen[p]; !ok && len(l.seen) >= l.max {
+		for q, t := range l.seen {
+			if now.Sub(t) >= l.window {
+				delete(l.seen, q)
+			}
+		}
+		if len(l.seen) >= l.max {
+			return false
+		}
+	}
+	l.seen[p] = now
+	return true
+}
+
+// pruneBefore removes all timestamps before t from the sorted slice ts.
+func pruneBefore(ts []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(t) {
+		i++
+	}
+	return append(ts[:0], ts[i:]...)
+}
+
+// reserveInboundMemory reserves n bytes of the memory budget set with
+// MaxInboundMemory, and reports whether the reservation succeeded.
+func (ps *PingService) reserveInboundMemory(n int64) bool {
+	used := atomic.AddInt64(&ps.inboundMemory, n)
+	if ps.maxInboundMemory > 0 && used > ps.maxInboundMemory {
+		atomic.AddInt64(&ps.inboundMemory, -n)
+		return false
+	}
+	ps.metricsTracer.InboundMemory(used)
+	return true
+}
+
+func (ps *PingService) releaseInboundMemory(n int64) {
+	ps.metricsTracer.InboundMemory(atomic.AddInt64(&ps.inboundMemory, -n))
+}
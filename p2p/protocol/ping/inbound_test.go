@@ -0,0 +1,55 @@
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStormDetector(t *testing.T) {
+	d := newStormDetector(2, time.Minute)
+	p1, p2 := peer.ID("p1"), peer.ID("p2")
+	now := time.Now()
+
+	require.True(t, d.allow(p1, now))
+	require.True(t, d.allow(p1, now.Add(time.Second)))
+	require.False(t, d.allow(p1, now.Add(2*time.Second)), "third stream within the window")
+	require.True(t, d.allow(p2, now.Add(2*time.Second)), "other peers are not affected")
+
+	// still cooling down
+	require.False(t, d.allow(p1, now.Add(time.Minute)))
+	// cooldown over
+	require.True(t, d.allow(p1, now.Add(2*time.Minute+3*time.Second)))
+
+	// stale peers are removed
+	d.allow(p1, now.Add(time.Hour))
+	require.Len(t, d.peers, 1)
+}
+
+func TestInboundMemoryLimit(t *testing.T) {
+	ps := newPingService(nil)
+	ps.maxInboundMemory = 2 * PingSize
+
+	require.True(t, ps.reserveInboundMemory(PingSize))
+	require.True(t, ps.reserveInboundMemory(PingSize))
+	require.False(t, ps.reserveInboundMemory(PingSize))
+	ps.releaseInboundMemory(PingSize)
+	require.True(t, ps.reserveInboundMemory(PingSize))
+}
+
+func TestPeerLimiter(t *testing.T) {
+	l := newPeerLimiter(2, time.Minute)
+	p1, p2, p3 := peer.ID("p1"), peer.ID("p2"), peer.ID("p3")
+	now := time.Now()
+
+	require.True(t, l.allow(p1, now))
+	require.True(t, l.allow(p2, now.Add(time.Second)))
+	require.False(t, l.allow(p3, now.Add(2*time.Second)), "third distinct peer within the window")
+	require.True(t, l.allow(p1, now.Add(30*time.Second)), "known peers are still served")
+
+	// p2 expired, p1 was served recently
+	require.True(t, l.allow(p3, now.Add(time.Minute+time.Second)))
+	require.False(t, l.allow(p2, now.Add(time.Minute+2*time.Second)))
+}
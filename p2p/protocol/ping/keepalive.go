@@ -0,0 +1,76 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// KeepaliveID is a lightweight variant of the ping protocol, for keeping
+// connections alive rather than measuring them. Every round is a single byte,
+// echoed back as is. It is only served with ServeExtensions; Keepalive falls
+// back to ID with peers not serving it.
+const KeepaliveID = "/ipfs/ping/keepalive/1.0.0"
+
+func (p *PingService) keepaliveHandler(s network.Stream) {
+	p.handle(s, 1, func(buf []byte) error {
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return err
+		}
+		if p.noEcho {
+			return nil
+		}
+		return writeFull(s, buf)
+	})
+}
+
+// Keepalive keeps the connection to p alive by exchanging a single byte with
+// it every interval, using the KeepaliveID protocol, or a regular ping round
+// if p doesn't support it. No RTT is measured. It runs until the context is
+// done, returning its error, or until a round fails. The interval must be
+// shorter than the peer's idle timeout, 60s by default.
+func Keepalive(ctx context.Context, h host.Host, p peer.ID, interval time.Duration) error {
+	return newPingService(h).Keepalive(ctx, p, interval)
+}
+
+// Keepalive keeps the connection to p alive. See the package level Keepalive.
+func (ps *PingService) Keepalive(ctx context.Context, p peer.ID, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("keepalive interval must be positive")
+	}
+	if p == ps.Host.ID() && !ps.allowSelf {
+		return ErrPingSelf
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s, _, err := ps.openInitialStreamTo(ctx, p, []protocol.ID{KeepaliveID, ID})
+	if err != nil {
+		return err
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := ps.pingWithTimeout(ctx, s, nil, false); err != nil {
+			s.Reset()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+}
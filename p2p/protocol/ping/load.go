@@ -0,0 +1,81 @@
+package ping
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// startLoad starts the background streams set with the ConcurrentLoad option.
+// The returned function stops them, and waits for them to be cleaned up.
+func (sess *session) startLoad(ctx context.Context) (stop func()) {
+	ps := sess.ps
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < ps.loadStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess.load(ctx)
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// load sends ping payloads at the configured rate over a dedicated stream,
+// until the context is canceled.
+func (sess *session) load(ctx context.Context) {
+	ps := sess.ps
+	s, err := ps.Host.NewStream(network.WithUseTransient(ctx, "ping"), sess.p, ID)
+	if err != nil {
+		ps.debugf(sess.p, "failed to open ping load stream to %s: %s", sess.p, err)
+		return
+	}
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		log.Debugf("error attaching stream to ping service: %s", err)
+		s.Reset()
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		s.Reset()
+	}()
+
+	var interval time.Duration
+	if ps.loadRate > 0 {
+		interval = time.Second * PingSize / time.Duration(ps.loadRate)
+	}
+	buf := make([]byte, PingSize)
+	next := time.Now()
+	for ctx.Err() == nil {
+		if err := writeFull(s, buf); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return
+		}
+		if interval > 0 {
+			next = next.Add(interval)
+			if wait := time.Until(next); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+				}
+			}
+		}
+	}
+}
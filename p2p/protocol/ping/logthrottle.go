@@ -0,0 +1,95 @@
+package ping
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// logThrottle logs identical messages about a peer at most once per window,
+// see ThrottleLogs.
+type logThrottle struct {
+	window time.Duration
+
+	mx        sync.Mutex
+	entries   map[logKey]*logEntry
+	lastSweep time.Time
+}
+
+type logKey struct {
+	p   peer.ID
+	msg string
+}
+
+type logEntry struct {
+	logged     time.Time
+	suppressed int // since logged
+}
+
+func newLogThrottle(window time.Duration) *logThrottle {
+	return &logThrottle{
+		window:  window,
+		entries: make(map[logKey]*logEntry),
+	}
+}
+
+// allow records an occurrence of msg about p, and reports whether it should
+// be logged, along with the number of occurrences suppressed since it was
+// last logged.
+func (l *logThrottle) allow(p peer.ID, msg string, now time.Time) (ok bool, suppressed int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if now.Sub(l.lastSweep) > l.window {
+		l.sweep(now)
+	}
+
+	key := logKey{p: p, msg: msg}
+	e, ok := l.entries[key]
+	if !ok {
+		l.entries[key] = &logEntry{logged: now}
+		return true, 0
+	}
+	if now.Sub(e.logged) < l.window {
+		e.suppressed++
+		return false, 0
+	}
+	suppressed = e.suppressed
+	e.logged = now
+	e.suppressed = 0
+	return true, suppressed
+}
+
+// sweep forgets messages that weren't logged for two windows, logging how
+// often they were suppressed, if at all.
+func (l *logThrottle) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, e := range l.entries {
+		if now.Sub(e.logged) < 2*l.window {
+			continue
+		}
+		if e.suppressed > 0 {
+			log.Debugf("%s (repeated %d times)", key.msg, e.suppressed)
+		}
+		delete(l.entries, key)
+	}
+}
+
+// debugf logs a debug message about p, throttled if set with ThrottleLogs.
+func (ps *PingService) debugf(p peer.ID, format string, args ...any) {
+	if ps.logs == nil {
+		log.Debugf(format, args...)
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	ok, suppressed := ps.logs.allow(p, msg, time.Now())
+	switch {
+	case !ok:
+	case suppressed > 0:
+		log.Debugf("%s (still failing, %d times since last logged)", msg, suppressed+1)
+	default:
+		log.Debug(msg)
+	}
+}
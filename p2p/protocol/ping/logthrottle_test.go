@@ -0,0 +1,34 @@
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogThrottle(t *testing.T) {
+	l := newLogThrottle(time.Minute)
+	now := time.Now()
+	check := func(at time.Duration, msg string, ok bool, suppressed int) {
+		t.Helper()
+		gotOK, gotSuppressed := l.allow("peer", msg, now.Add(at))
+		require.Equal(t, ok, gotOK)
+		require.Equal(t, suppressed, gotSuppressed)
+	}
+
+	check(0, "failed", true, 0)
+	check(time.Second, "failed", false, 0)
+	check(2*time.Second, "failed", false, 0)
+	// another message, or the same one about another peer, is logged
+	check(2*time.Second, "other", true, 0)
+	ok, _ := l.allow("other peer", "failed", now.Add(2*time.Second))
+	require.True(t, ok)
+	// once the window elapsed, with the number of suppressed occurrences
+	check(time.Minute, "failed", true, 2)
+	check(2*time.Minute, "failed", true, 0)
+
+	// messages not seen for a while are forgotten
+	l.allow("peer", "failed", now.Add(10*time.Minute))
+	require.Len(t, l.entries, 1)
+}
@@ -0,0 +1,143 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// default number of peers PingMany connects to and pings concurrently
+const defaultManyConcurrency = 16
+
+// PeerResult is the outcome of pinging one of the peers of PingMany.
+type PeerResult struct {
+	Statistics
+	// DialError is set if the peer couldn't be connected to before the
+	// measurements started. No ping is attempted to such a peer.
+	DialError error
+	// Error is set if the ping session ended before all rounds completed.
+	Error error
+}
+
+// PingMany pings every peer in peers for the given number of rounds, and
+// returns the results by peer.
+//
+// Peers that are not connected yet are all dialed first, so that the measured
+// RTTs aren't skewed by connection setup. Both the dials and the measurements
+// run concurrently, up to the limit set with ManyConcurrency.
+func (ps *PingService) PingMany(ctx context.Context, peers []peer.ID, rounds int) map[peer.ID]PeerResult {
+	limit := ps.manyConcurrency
+	if limit <= 0 {
+		limit = defaultManyConcurrency
+	}
+
+	var mx sync.Mutex
+	results := make(map[peer.ID]PeerResult, len(peers))
+	forEach := func(peers []peer.ID, f func(p peer.ID)) {
+		sem := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+		for _, p := range peers {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(p peer.ID) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				f(p)
+			}(p)
+		}
+		wg.Wait()
+	}
+
+	// pre-connect phase
+	var connected []peer.ID
+	forEach(peers, func(p peer.ID) {
+		var err error
+		if ps.Host.Network().Connectedness(p) != network.Connected {
+			err = ps.Host.Connect(ctx, peer.AddrInfo{ID: p})
+		}
+		mx.Lock()
+		defer mx.Unlock()
+		if err != nil {
+			results[p] = PeerResult{DialError: err}
+			return
+		}
+		connected = append(connected, p)
+	})
+
+	forEach(connected, func(p peer.ID) {
+		st, err := ps.Collect(ctx, p, rounds)
+		mx.Lock()
+		results[p] = PeerResult{Statistics: st, Error: err}
+		mx.Unlock()
+	})
+	return results
+}
+
+// Compare pings a and b concurrently for the given number of rounds, and
+// returns the peer with the lower median RTT, along with the statistics of
+// both. If only one of the peers could be measured, it is returned as the
+// faster one. If neither could, Compare returns an error. Ties go to a.
+func Compare(ctx context.Context, h host.Host, a, b peer.ID, rounds int) (faster peer.ID, statsA, statsB Statistics, err error) {
+	ps := newPingService(h)
+	var errA, errB error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		statsA, errA = ps.Collect(ctx, a, rounds)
+	}()
+	go func() {
+		defer wg.Done()
+		statsB, errB = ps.Collect(ctx, b, rounds)
+	}()
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return "", statsA, statsB, err
+	}
+	switch {
+	case statsA.Received == 0 && statsB.Received == 0:
+		return "", statsA, statsB, fmt.Errorf("neither peer could be measured: %s: %v, %s: %v", a, errA, b, errB)
+	case statsB.Received == 0:
+		return a, statsA, statsB, nil
+	case statsA.Received == 0:
+		return b, statsA, statsB, nil
+	case statsB.P50 < statsA.P50:
+		return b, statsA, statsB, nil
+	default:
+		return a, statsA, statsB, nil
+	}
+}
+
+// PingBidirectional makes a and b ping each other concurrently for the given
+// number of rounds, and returns the statistics of both directions. Measuring
+// both directions under the same load reveals asymmetric routing or queuing.
+// Both hosts must have a PingService registered. It returns the statistics
+// gathered in both directions along with the first error the directions
+// failed with, as returned by Collect.
+func PingBidirectional(ctx context.Context, a, b host.Host, rounds int) (aToB, bToA Statistics, err error) {
+	var errAB, errBA error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aToB, errAB = newPingService(a).Collect(ctx, b.ID(), rounds)
+	}()
+	go func() {
+		defer wg.Done()
+		bToA, errBA = newPingService(b).Collect(ctx, a.ID(), rounds)
+	}()
+	wg.Wait()
+
+	switch {
+	case errAB != nil:
+		err = fmt.Errorf("ping from %s to %s: %w", a.ID(), b.ID(), errAB)
+	case errBA != nil:
+		err = fmt.Errorf("ping from %s to %s: %w", b.ID(), a.ID(), errBA)
+	}
+	return aToB, bToA, err
+}
@@ -0,0 +1,126 @@
+package ping
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsTracer is notified of ping service events that are worth exporting
+// as metrics. Use NewMetricsTracer to export them to Prometheus.
+type MetricsTracer interface {
+	// InboundStreamRejected is called when the handler rejects an inbound
+	// ping stream, with the reason it was rejected for.
+	InboundStreamRejected(reason string)
+	// InboundMemory is called with the memory used by all inbound ping
+	// streams whenever it changes.
+	InboundMemory(bytes int64)
+	// StreamReopened is called when a broken outbound ping stream was
+	// replaced in resilient mode, with the transport of the new stream.
+	StreamReopened(transport string)
+	// RoundCompleted is called with the RTT of every successful outbound
+	// round, and the transport it went over.
+	RoundCompleted(transport string, rtt time.Duration)
+	// StreamOpenTime is called with the time it took to open and negotiate
+	// every outbound ping stream, and the transport it was opened over.
+	StreamOpenTime(transport string, d time.Duration)
+	// HandlerQueueDepth is called with the number of inbound ping streams
+	// waiting for a worker of the HandlerPool whenever it changes.
+	HandlerQueueDepth(n int)
+}
+
+type nopMetricsTracer struct{}
+
+var _ MetricsTracer = nopMetricsTracer{}
+
+func (nopMetricsTracer) InboundStreamRejected(string)         {}
+func (nopMetricsTracer) InboundMemory(int64)                  {}
+func (nopMetricsTracer) StreamReopened(string)                {}
+func (nopMetricsTracer) RoundCompleted(string, time.Duration) {}
+func (nopMetricsTracer) StreamOpenTime(string, time.Duration) {}
+func (nopMetricsTracer) HandlerQueueDepth(int)                {}
+
+var (
+	registerMetricsOnce sync.Once
+
+	rejectedStreams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "libp2p_ping_inbound_streams_rejected_total",
+			Help: "Inbound ping streams rejected by the handler",
+		},
+		[]string{"reason"},
+	)
+	inboundMemory = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "libp2p_ping_inbound_memory_bytes",
+			Help: "Memory used by inbound ping streams",
+		},
+	)
+	reopenedStreams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "libp2p_ping_streams_reopened_total",
+			Help: "Outbound ping streams reopened after a failure",
+		},
+		[]string{"transport"},
+	)
+	roundRTT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "libp2p_ping_rtt_seconds",
+			Help:    "RTT of successful outbound ping rounds",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"transport"},
+	)
+	streamOpenTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "libp2p_ping_stream_open_seconds",
+			Help:    "Time to open and negotiate outbound ping streams",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"transport"},
+	)
+	handlerQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "libp2p_ping_handler_queue_depth",
+			Help: "Inbound ping streams waiting for a handler pool worker",
+		},
+	)
+)
+
+type metricsTracer struct{}
+
+var _ MetricsTracer = metricsTracer{}
+
+// NewMetricsTracer returns a MetricsTracer exporting the ping service metrics
+// to the default Prometheus registry.
+func NewMetricsTracer() MetricsTracer {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(rejectedStreams, inboundMemory, reopenedStreams, roundRTT, streamOpenTime, handlerQueueDepth)
+	})
+	return metricsTracer{}
+}
+
+func (metricsTracer) InboundStreamRejected(reason string) {
+	rejectedStreams.WithLabelValues(reason).Inc()
+}
+
+func (metricsTracer) InboundMemory(bytes int64) {
+	inboundMemory.Set(float64(bytes))
+}
+
+func (metricsTracer) StreamReopened(transport string) {
+	reopenedStreams.WithLabelValues(transport).Inc()
+}
+
+func (metricsTracer) RoundCompleted(transport string, rtt time.Duration) {
+	roundRTT.WithLabelValues(transport).Observe(rtt.Seconds())
+}
+
+func (metricsTracer) StreamOpenTime(transport string, d time.Duration) {
+	streamOpenTime.WithLabelValues(transport).Observe(d.Seconds())
+}
+
+func (metricsTracer) HandlerQueueDepth(n int) {
+	handlerQueueDepth.Set(float64(n))
+}
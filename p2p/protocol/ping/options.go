@@ -0,0 +1,836 @@
+package ping
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+type Option func(*PingService) error
+
+// Timeout sets the time after which inbound streams the peer stopped sending
+// on are reset, and outbound rounds the peer doesn't answer fail with
+// ErrRoundTimeout. It defaults to 60s. Unless a timeout is set explicitly,
+// outbound rounds are bounded by the remaining time of the context's deadline
+// instead, if it's shorter.
+func Timeout(timeout time.Duration) Option {
+	return func(ps *PingService) error {
+		ps.timeoutSet = timeout != 0
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		ps.timeout = timeout
+		return nil
+	}
+}
+
+// MeasureLocalDelay enables measuring the local scheduling delay of every
+// round, reported as DetailedResult.SchedDelay.
+// This helps distinguishing an overloaded node from a slow network.
+func MeasureLocalDelay(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.measureLocalDelay = enable
+		return nil
+	}
+}
+
+// OnResult sets a callback that is invoked with the result of every ping round.
+// The callback is called synchronously from the ping loop, and must not block.
+// Use WithSessionTag to tell concurrent sessions apart.
+func OnResult(f func(p peer.ID, res Result)) Option {
+	return func(ps *PingService) error {
+		ps.onResult = f
+		return nil
+	}
+}
+
+// WithMetricsTracer sets the tracer that is notified of events worth exporting
+// as metrics.
+func WithMetricsTracer(mt MetricsTracer) Option {
+	return func(ps *PingService) error {
+		ps.metricsTracer = mt
+		return nil
+	}
+}
+
+// StreamStormThreshold makes the handler reject all inbound streams from a peer
+// for the duration of window, once the peer opened more than count streams
+// within window. This protects against peers exhausting resources by opening
+// many ping streams.
+func StreamStormThreshold(count int, window time.Duration) Option {
+	return func(ps *PingService) error {
+		if count <= 0 || window <= 0 {
+			return errors.New("stream storm threshold count and window must be positive")
+		}
+		ps.storms = newStormDetector(count, window)
+		return nil
+	}
+}
+
+// MaxDistinctPeers makes the handler serve at most n distinct peers within a
+// rolling window, resetting the streams of any further peer. A peer stops
+// counting towards the limit once window elapsed since it was last served.
+// This protects against sweeps of many peers pinging once each, without
+// affecting a small set of regular monitors.
+func MaxDistinctPeers(n int, window time.Duration) Option {
+	return func(ps *PingService) error {
+		if n <= 0 || window <= 0 {
+			return errors.New("distinct peers limit and window must be positive")
+		}
+		ps.distinctPeers = newPeerLimiter(n, window)
+		return nil
+	}
+}
+
+// OutlierFactor makes the service record rounds whose RTT exceeds factor times
+// the median of the recent RTTs to the same peer. The most recent outliers can
+// be retrieved with PingService.Outliers.
+func OutlierFactor(factor float64) Option {
+	return func(ps *PingService) error {
+		if factor <= 1 {
+			return errors.New("outlier factor must be greater than 1")
+		}
+		ps.outlierFactor = factor
+		return nil
+	}
+}
+
+// Resilient makes outbound ping sessions replace their stream when a round
+// fails because of a stream error or a payload mismatch, instead of failing
+// every subsequent round. Reopening is retried with an exponential backoff
+// starting at backoff. Streams over transient connections are also migrated
+// to a direct connection to the peer once one is established, e.g. by a hole
+// punch.
+func Resilient(backoff time.Duration) Option {
+	return func(ps *PingService) error {
+		if backoff <= 0 {
+			return errors.New("resilient backoff must be positive")
+		}
+		ps.reopenBackoff = backoff
+		return nil
+	}
+}
+
+// AlertThresholds makes the service emit an EvtPingAlert on the host's event
+// bus whenever the smoothed RTT to a peer moves between the ok, warn and
+// critical levels. A level is only left once the smoothed RTT drops more than
+// hysteresis below its threshold.
+func AlertThresholds(warn, critical, hysteresis time.Duration) Option {
+	return func(ps *PingService) error {
+		if warn <= 0 || critical < warn {
+			return errors.New("alert thresholds must be positive, with critical not below warn")
+		}
+		if hysteresis < 0 || hysteresis >= warn {
+			return errors.New("alert hysteresis must be non-negative and below the warn threshold")
+		}
+		if ps.Host == nil {
+			return errors.New("alert thresholds require a host")
+		}
+		em, err := ps.Host.EventBus().Emitter(new(EvtPingAlert))
+		if err != nil {
+			return err
+		}
+		ps.alerts = &alertThresholds{warn: warn, critical: critical, hysteresis: hysteresis}
+		ps.alertEmitter = em
+		return nil
+	}
+}
+
+// BatchSize makes every ping round write k payloads back to back before reading
+// their echoes, and report the average RTT of the payloads. This amortizes the
+// per-round overhead, and measures latency closer to a steady stream of data.
+func BatchSize(k int) Option {
+	return func(ps *PingService) error {
+		if k <= 0 {
+			return errors.New("batch size must be positive")
+		}
+		ps.batchSize = k
+		return nil
+	}
+}
+
+// MaxInboundMemory limits the memory used by all inbound ping streams served by
+// the handler. Streams are rejected once the limit is reached. This is a safety
+// valve independent of the resource manager's limits.
+func MaxInboundMemory(bytes int) Option {
+	return func(ps *PingService) error {
+		if bytes < PingSize {
+			return fmt.Errorf("max inbound memory must be at least %d bytes", PingSize)
+		}
+		ps.maxInboundMemory = int64(bytes)
+		return nil
+	}
+}
+
+// NoEcho makes the handler read and discard the payloads it receives instead
+// of echoing them back.
+// This breaks the ping protocol: peers pinging this node will time out. It is
+// only meant for diagnostics, e.g. studying how clients behave on timeouts.
+func NoEcho(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.noEcho = enable
+		return nil
+	}
+}
+
+// ExchangeTimestamps makes outbound ping sessions negotiate the TimestampExtID
+// or TimestampID extension of the protocol, falling back to the base protocol
+// if the peer supports neither. Sessions using an extension report the one-way
+// delay and clock offset estimates in their DetailedResults, and with
+// TimestampExtID the peer's processing time.
+// These estimates are only as accurate as the clocks of both nodes.
+func ExchangeTimestamps(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.timestamps = enable
+		return nil
+	}
+}
+
+// StartDelay makes outbound ping sessions wait for d before the first round,
+// letting a freshly established connection settle.
+func StartDelay(d time.Duration) Option {
+	return func(ps *PingService) error {
+		if d < 0 {
+			return errors.New("start delay must not be negative")
+		}
+		ps.startDelay = d
+		return nil
+	}
+}
+
+// Count makes outbound ping sessions stop after n rounds.
+func Count(n int) Option {
+	return func(ps *PingService) error {
+		if n <= 0 {
+			return errors.New("count must be positive")
+		}
+		ps.count = n
+		return nil
+	}
+}
+
+// Duration makes outbound ping sessions stop once d has elapsed. It can be
+// combined with Count, in which case the session stops at whichever limit is
+// reached first.
+func Duration(d time.Duration) Option {
+	return func(ps *PingService) error {
+		if d <= 0 {
+			return errors.New("duration must be positive")
+		}
+		ps.duration = d
+		return nil
+	}
+}
+
+// PayloadSize makes outbound ping sessions use payloads of the given size,
+// using the SizedID variant of the protocol. Peers that don't support it
+// can't be pinged with this option.
+func PayloadSize(size int) Option {
+	return func(ps *PingService) error {
+		if size <= 0 || size > MaxPayloadSize {
+			return fmt.Errorf("payload size must be between 1 and %d bytes", MaxPayloadSize)
+		}
+		ps.payloadSize = size
+		return nil
+	}
+}
+
+// KeepLastPayloads makes the service keep a copy of the payload of the last
+// outbound round to every peer, and of its echo, as returned by LastPayloads,
+// to debug payload mismatches. This retains two payloads, of the size set with
+// PayloadSize, for every peer pinged and for the lifetime of the service.
+func KeepLastPayloads(enable bool) Option {
+	return func(ps *PingService) error {
+		if enable {
+			ps.payloads = &payloadLog{peers: make(map[peer.ID]*payloadPair)}
+		} else {
+			ps.payloads = nil
+		}
+		return nil
+	}
+}
+
+// VerifyMode sets how the echoes of the payloads set with PayloadSize are
+// verified. Checksum is cheaper than the default FullCompare for large
+// payloads, but an echo corrupted in a way that preserves its CRC-32C, which
+// random corruption does with a probability of 2^-32, goes unnoticed. Payloads
+// of at most 4 bytes, and echoes checked by a VerifyFunc, are always compared
+// in full.
+func VerifyMode(mode VerificationMode) Option {
+	return func(ps *PingService) error {
+		if mode != FullCompare && mode != Checksum {
+			return fmt.Errorf("invalid verification mode: %d", mode)
+		}
+		ps.verifyMode = mode
+		return nil
+	}
+}
+
+// Heartbeat sets a function that is called once per iteration of outbound ping
+// sessions, whether the round succeeded or not. This allows observing the
+// liveness of the monitor itself, independently of the peer's. The function
+// is called synchronously from the ping loop, and must not block.
+func Heartbeat(f func()) Option {
+	return func(ps *PingService) error {
+		ps.heartbeat = f
+		return nil
+	}
+}
+
+// FreshStreamPerRound makes outbound ping sessions open a new stream for every
+// round, and close it once the round completes. The reported RTT then reflects
+// the cost of an on-demand ping rather than a steady-state one; the stream
+// negotiation time is reported separately in Result.StreamOpen.
+func FreshStreamPerRound(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.freshStream = enable
+		return nil
+	}
+}
+
+// NoIdleTimeout disables the idle timeout of inbound ping streams, which
+// otherwise resets streams the peer doesn't send on for the configured
+// Timeout. Liveness of such streams then relies solely on the transport and
+// the stream muxer.
+//
+// Use with care: a peer that goes quiet without closing its stream keeps it,
+// and the memory reserved for it, until the connection goes away. This is
+// only meant for trusted peers keeping intentionally long-lived ping streams.
+func NoIdleTimeout(disable bool) Option {
+	return func(ps *PingService) error {
+		ps.noIdleTimeout = disable
+		return nil
+	}
+}
+
+// OnStreamEvent sets a function that is called on every lifecycle transition
+// of the streams of outbound ping sessions: when a stream is opened, reset
+// after a failure, reopened in resilient mode, or closed after a round with
+// FreshStreamPerRound. The function is called synchronously from the ping
+// loop, and must return quickly.
+func OnStreamEvent(f func(StreamEvent)) Option {
+	return func(ps *PingService) error {
+		ps.onStreamEvent = f
+		return nil
+	}
+}
+
+// VerifyFunc sets the function used to check the echo received for every ping
+// payload, replacing the default exact match. This allows detecting specific
+// payload corruptions by middleboxes on the path. An error returned by f fails
+// the round.
+func VerifyFunc(f func(sent, received []byte) error) Option {
+	return func(ps *PingService) error {
+		ps.verifyFunc = f
+		return nil
+	}
+}
+
+// OnHandlerTimeout sets a function that is called with the peer of an
+// inbound ping stream that went idle for longer than the timeout, right
+// before the stream is reset. It is called at most once per stream, from the
+// stream's watchdog goroutine.
+func OnHandlerTimeout(f func(peer.ID)) Option {
+	return func(ps *PingService) error {
+		ps.onHandlerTimeout = f
+		return nil
+	}
+}
+
+// HandlerPool makes the handler serve inbound ping streams on a pool of at
+// most workers goroutines, bounding the number of goroutines serving pingers.
+// A worker serves a stream until it ends, so at most workers streams are
+// served concurrently. Further streams wait in a queue of up to queue
+// streams, and are rejected once it is full. The queue depth is reported to
+// the MetricsTracer.
+func HandlerPool(workers, queue int) Option {
+	return func(ps *PingService) error {
+		if workers < 1 {
+			return errors.New("handler pool needs at least 1 worker")
+		}
+		if queue < 0 {
+			return errors.New("handler pool queue size must not be negative")
+		}
+		ps.handlerPool = newHandlerPool(workers, queue, func(n int) { ps.metricsTracer.HandlerQueueDepth(n) })
+		return nil
+	}
+}
+
+// InboundFilter sets a function deciding which peers inbound pings are
+// answered for. Streams from peers it returns false for are reset right away,
+// without echoing. By default, all peers are answered.
+func InboundFilter(allow func(peer.ID) bool) Option {
+	return func(ps *PingService) error {
+		ps.inboundFilter = allow
+		return nil
+	}
+}
+
+// RecordLatency sets whether the RTTs measured by outbound ping sessions are
+// recorded to the peerstore. It is enabled by default.
+func RecordLatency(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.recordLatency = enable
+		return nil
+	}
+}
+
+// RecordLatencyFilter keeps RTTs exceeding factor times the smoothed RTT of
+// the peer out of the peerstore, so that spikes don't poison latency based
+// decisions. Such RTTs are still reported in the results, and still move the
+// smoothed RTT, so that lasting changes are eventually recorded. The factor
+// must be greater than 1.
+func RecordLatencyFilter(factor float64) Option {
+	return func(ps *PingService) error {
+		if factor <= 1 {
+			return errors.New("latency record filter factor must be greater than 1")
+		}
+		ps.recordFilter = factor
+		return nil
+	}
+}
+
+// SkipFirstLatencyRecord sets whether the RTT of the first successful round
+// of outbound ping sessions is left out of the peerstore, as it often
+// includes the cost of dialing and negotiating the stream. Later rounds are
+// recorded as usual.
+func SkipFirstLatencyRecord(skip bool) Option {
+	return func(ps *PingService) error {
+		ps.skipFirstRecord = skip
+		return nil
+	}
+}
+
+// ManyConcurrency sets the maximum number of peers PingMany dials and pings
+// concurrently. It defaults to 16.
+func ManyConcurrency(n int) Option {
+	return func(ps *PingService) error {
+		if n < 1 {
+			return errors.New("concurrency must be at least 1")
+		}
+		ps.manyConcurrency = n
+		return nil
+	}
+}
+
+// AllowSelf allows pinging the host's own peer ID, for loopback testing. By
+// default this fails with ErrPingSelf. Note that the default swarm refuses to
+// dial self, so this is only useful with networks that support it.
+func AllowSelf(allow bool) Option {
+	return func(ps *PingService) error {
+		ps.allowSelf = allow
+		return nil
+	}
+}
+
+// BucketBy sets the window over which BucketedResults aggregates results.
+func BucketBy(d time.Duration) Option {
+	return func(ps *PingService) error {
+		if d <= 0 {
+			return errors.New("bucket window must be positive")
+		}
+		ps.bucketWindow = d
+		return nil
+	}
+}
+
+// ConcurrentLoad makes outbound ping sessions run the given number of
+// background streams to the peer alongside the measured one, each echoing ping
+// payloads at up to bytesPerSec (or as fast as possible if zero). The reported
+// RTTs then reflect a loaded link, revealing queuing and head-of-line blocking
+// that idle pings miss. The background streams are reset when the session
+// ends.
+func ConcurrentLoad(streams int, bytesPerSec int) Option {
+	return func(ps *PingService) error {
+		if streams < 0 || bytesPerSec < 0 {
+			return errors.New("concurrent load must not be negative")
+		}
+		ps.loadStreams = streams
+		ps.loadRate = bytesPerSec
+		return nil
+	}
+}
+
+// BeforeStream sets a function that is called on every stream opened by
+// outbound ping sessions, before it is used. It may customize the stream, for
+// example by setting deadlines or adjusting its scope. If it returns an error,
+// the stream is reset and the error is reported as the result of the attempt.
+func BeforeStream(f func(network.Stream) error) Option {
+	return func(ps *PingService) error {
+		ps.beforeStream = f
+		return nil
+	}
+}
+
+// ThrottleLogs makes the service log identical debug messages about a peer,
+// such as the error of every failed round while the peer is down, at most
+// once per window. When a message is logged again, the number of times it
+// occurred since is logged along with it.
+func ThrottleLogs(window time.Duration) Option {
+	return func(ps *PingService) error {
+		if window <= 0 {
+			return errors.New("log throttling window must be positive")
+		}
+		ps.logs = newLogThrottle(window)
+		return nil
+	}
+}
+
+// SuppressRepeatedErrors suppresses failed rounds to a peer for the given
+// window after a failed round was delivered, until a round succeeds again.
+// Consumers of flapping peers then see a single error per window rather than
+// bursts of them. The state is tracked per peer, across concurrent sessions.
+func SuppressRepeatedErrors(window time.Duration) Option {
+	return func(ps *PingService) error {
+		ps.errorDedup = window
+		return nil
+	}
+}
+
+// MinSamples sets the minimum number of successful rounds for Collect to
+// report statistics without ErrInsufficientSamples. It defaults to 3.
+func MinSamples(n int) Option {
+	return func(ps *PingService) error {
+		if n < 1 {
+			return errors.New("minimum number of samples must be at least 1")
+		}
+		ps.minSamples = n
+		return nil
+	}
+}
+
+// RotateConnections makes outbound ping sessions open the stream of every
+// round on a different connection to the peer, round-robin, so that per-path
+// latency differences surface. Result.Conn identifies the connection of every
+// round. With a single connection to the peer, it is used for every round.
+func RotateConnections(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.rotateConns = enable
+		return nil
+	}
+}
+
+// ScoreReporter sets a function that is called after every attempt of
+// outbound ping sessions, with a delta of 1 if it succeeded and -1 if it
+// failed, including failures to open a stream. This allows feeding peer
+// liveness into application level peer scoring; the scoring policy is up to
+// the application. The function is called synchronously from the ping loop,
+// and must return quickly.
+func ScoreReporter(f func(p peer.ID, delta float64)) Option {
+	return func(ps *PingService) error {
+		ps.scoreReporter = f
+		return nil
+	}
+}
+
+// LowLatency makes outbound ping sessions disable send coalescing (like
+// TCP_NODELAY) on their streams, where supported, to avoid measurement
+// artifacts. It applies to streams or connections implementing
+// SetNoDelay(bool) error, and is a no-op for others.
+//
+// None of the built-in transports need it: Go already sets TCP_NODELAY on TCP
+// sockets (so TCP and WebSocket connections don't coalesce sends), and the
+// QUIC based transports don't delay sends Nagle-style. It is meant for custom
+// transports exposing such a setting.
+func LowLatency(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.lowLatency = enable
+		return nil
+	}
+}
+
+// ReservationPriority sets the priority of the memory reservations made for
+// ping streams, both inbound and outbound, see network.ResourceScope. It
+// defaults to network.ReservationPriorityAlways; lower priorities make ping
+// yield to other traffic when memory gets scarce.
+func ReservationPriority(prio uint8) Option {
+	return func(ps *PingService) error {
+		ps.reservePriority = prio
+		return nil
+	}
+}
+
+// MeasureEvery makes outbound ping sessions measure only every nth round. The
+// rounds in between just keep the connection alive: they echo a zero payload
+// without timing it or checking the echo, and are not reported unless they
+// fail. It applies to streams of the ID protocol without BatchSize, other
+// rounds are always measured. It defaults to measuring every round.
+func MeasureEvery(n int) Option {
+	return func(ps *PingService) error {
+		if n < 1 {
+			return errors.New("measurement interval must be at least 1")
+		}
+		ps.measureEvery = n
+		return nil
+	}
+}
+
+// DialTimeout caps the time outbound ping sessions may take to open a
+// stream, including dialing a new connection, independently of the round
+// timeout. This allows a generous dial while demanding fast rounds. By
+// default, only the context of the session limits it.
+func DialTimeout(d time.Duration) Option {
+	return func(ps *PingService) error {
+		if d <= 0 {
+			return errors.New("dial timeout must be positive")
+		}
+		ps.dialTimeout = d
+		return nil
+	}
+}
+
+// DialRetries makes ping sessions retry opening their first stream up to n
+// times, waiting backoff between attempts, before giving up. This helps when
+// starting to ping a peer whose connection is still being established. It
+// defaults to no retries.
+func DialRetries(n int, backoff time.Duration) Option {
+	return func(ps *PingService) error {
+		if n < 0 {
+			return errors.New("number of dial retries must not be negative")
+		}
+		if backoff < 0 {
+			return errors.New("dial retry backoff must not be negative")
+		}
+		ps.dialRetries = n
+		ps.dialBackoff = backoff
+		return nil
+	}
+}
+
+// Schedule makes outbound ping sessions send every round at the next multiple
+// of align in wall-clock time, e.g. at every 10s mark of the clock, so that
+// nodes with synchronized clocks measure at the same instants. Rounds that
+// take longer than align skip the boundaries they missed. It defaults to 0,
+// sending rounds back to back. Peers reset streams idle for longer than their
+// timeout, 60s by default, so align must be shorter than that, unless
+// combined with Resilient or FreshStreamPerRound.
+func Schedule(align time.Duration) Option {
+	return func(ps *PingService) error {
+		if align < 0 {
+			return errors.New("schedule alignment must not be negative")
+		}
+		ps.schedule = align
+		return nil
+	}
+}
+
+// SmoothingHalfLife makes the smoothed RTT, which alerts are based on and
+// ServeDebug reports, a time-decayed average: the weight of the previous
+// estimate halves with every halfLife elapsed between samples, instead of
+// decreasing by a fixed factor per sample. This gives more accurate estimates
+// when rounds are irregularly spaced. It defaults to 0, using the fixed
+// factor.
+func SmoothingHalfLife(halfLife time.Duration) Option {
+	return func(ps *PingService) error {
+		if halfLife < 0 {
+			return errors.New("smoothing half-life must not be negative")
+		}
+		ps.halfLife = halfLife
+		return nil
+	}
+}
+
+// DisableBufferPool makes the service allocate fresh buffers for every round
+// instead of reusing pooled ones, and overwrite buffers once it is done with
+// them. This is meant for tests: buffers mutated or read after their release
+// then surface as corrupted payloads or under the race detector, instead of
+// going unnoticed. It defaults to false, pooling buffers.
+func DisableBufferPool(disable bool) Option {
+	return func(ps *PingService) error {
+		ps.noPool = disable
+		return nil
+	}
+}
+
+// HealthSink sets a function that is called when the health of a peer changes,
+// as seen by outbound ping sessions: the peer becomes healthy after a number
+// of consecutive successful attempts, and unhealthy after a number of
+// consecutive failed ones, see HealthThresholds. The health is tracked from
+// the start of the first active session to the peer. This allows feeding
+// liveness into service discovery; the function is called synchronously from
+// the ping loop, and must return quickly.
+func HealthSink(f func(p peer.ID, healthy bool)) Option {
+	return func(ps *PingService) error {
+		ps.healthSink = f
+		return nil
+	}
+}
+
+// HealthThresholds sets the number of consecutive successful attempts for a
+// peer to become healthy, and of consecutive failed attempts for it to become
+// unhealthy, as reported to the HealthSink. They default to 1 and 3.
+func HealthThresholds(healthy, unhealthy int) Option {
+	return func(ps *PingService) error {
+		if healthy < 1 || unhealthy < 1 {
+			return errors.New("health thresholds must be at least 1")
+		}
+		ps.healthyAfter = healthy
+		ps.unhealthyAfter = unhealthy
+		return nil
+	}
+}
+
+// WithTracer sets the tracer that is notified of every measured outbound ping
+// round, e.g. to export rounds as OpenTelemetry spans. It defaults to none.
+func WithTracer(t Tracer) Option {
+	return func(ps *PingService) error {
+		ps.tracer = t
+		return nil
+	}
+}
+
+// ResetOnCancel makes outbound ping sessions reset their stream when they are
+// canceled, interrupting any round in progress. By default, the stream is
+// closed, so that the peer sees a clean close rather than an error, and only
+// reset if the round in progress doesn't complete within a second.
+func ResetOnCancel(reset bool) Option {
+	return func(ps *PingService) error {
+		ps.resetOnCancel = reset
+		return nil
+	}
+}
+
+// DropRate makes outbound ping sessions report the given fraction of their
+// measured rounds, from 0 to 1, as lost: the round completes, but is reported
+// as failed with ErrRoundTimeout, and handled like a timeout otherwise. The
+// dropped rounds are chosen pseudo-randomly with a fixed seed, so that every
+// session drops the same rounds. This is meant for testing consumers' loss
+// handling only.
+func DropRate(p float64) Option {
+	return func(ps *PingService) error {
+		if p < 0 || p > 1 {
+			return errors.New("drop rate must be between 0 and 1")
+		}
+		ps.dropRate = p
+		return nil
+	}
+}
+
+// OnWire sets a function that is called with the time every payload of an
+// outbound ping round was written, and every echo read, to correlate rounds
+// with packet captures. The function is called synchronously from the ping
+// loop, possibly concurrently with batching, and must return quickly.
+func OnWire(f func(WireEvent)) Option {
+	return func(ps *PingService) error {
+		ps.onWire = f
+		return nil
+	}
+}
+
+// LivenessProbe makes outbound ping sessions probe the connection of a round
+// that timed out, with a keepalive round over a new stream that must complete
+// within the given timeout. A round whose probe fails times out with
+// ErrStreamDead, and with ErrEchoSlow otherwise. Without a probe, only the
+// connection being closed tells the two apart.
+func LivenessProbe(timeout time.Duration) Option {
+	return func(ps *PingService) error {
+		if timeout <= 0 {
+			return errors.New("liveness probe timeout must be positive")
+		}
+		ps.livenessProbe = timeout
+		return nil
+	}
+}
+
+// ContinueFunc sets a function that decides whether outbound ping sessions
+// go on, called with the statistics of the results delivered so far after
+// every result. Returning false ends the session, closing its channel. This
+// allows adaptive stop conditions, such as stopping once the loss exceeds a
+// threshold. Count and Duration still apply.
+func ContinueFunc(f func(Statistics) bool) Option {
+	return func(ps *PingService) error {
+		ps.continueFunc = f
+		return nil
+	}
+}
+
+// MaxAcceptableRTT sets a ceiling on the RTT of outbound ping rounds. A round
+// completing above it is reported as failed with ErrRTTExceeded, its RTT
+// still set, so that pathologically slow paths are pruned quickly: in
+// resilient mode, see Resilient, the stream is reset and reopened like
+// after any failed round, which is reported as a StreamReset event.
+func MaxAcceptableRTT(d time.Duration) Option {
+	return func(ps *PingService) error {
+		if d <= 0 {
+			return errors.New("maximum acceptable RTT must be positive")
+		}
+		ps.maxRTT = d
+		return nil
+	}
+}
+
+// AdditionalProtocolIDs registers the ping handler under the given protocol
+// IDs besides ID, for interoperability with implementations using different
+// IDs for the same protocol. Outbound sessions negotiate them, in order, if
+// the peer doesn't support ID.
+func AdditionalProtocolIDs(ids ...protocol.ID) Option {
+	return func(ps *PingService) error {
+		for _, id := range ids {
+			if id == "" {
+				return errors.New("protocol ID must not be empty")
+			}
+		}
+		ps.extraIDs = append(ps.extraIDs, ids...)
+		return nil
+	}
+}
+
+// StreamRotateInterval makes outbound ping sessions replace their stream
+// once it has been in use for d, closing it after a successful round and
+// opening a new one for the next round, so that long-lived streams don't
+// accumulate state. Rotations are reported as StreamRotated events, and don't
+// otherwise show in the results.
+func StreamRotateInterval(d time.Duration) Option {
+	return func(ps *PingService) error {
+		if d <= 0 {
+			return errors.New("stream rotation interval must be positive")
+		}
+		ps.rotateInterval = d
+		return nil
+	}
+}
+
+// MeasureOverhead sets whether the service records its own cost for every
+// successful measured outbound round: the processing time, excluding the wait
+// for the echo, and the heap allocations. The totals are reported by
+// Overhead. Counting allocations briefly stops the world twice per round, so
+// this is meant for profiling, and is disabled by default.
+func MeasureOverhead(enable bool) Option {
+	return func(ps *PingService) error {
+		if enable {
+			ps.overhead = &overheadMeter{}
+		} else {
+			ps.overhead = nil
+		}
+		return nil
+	}
+}
+
+// RejectUnsolicitedData makes outbound ping sessions check, before every round
+// over a reused stream, that the peer didn't send data since the last echo,
+// and reset the stream with ErrUnsolicitedData if it did, rather than
+// mistaking the data for the next echo. The check waits for data for up to a
+// millisecond, which delays every such round, so it is disabled by default;
+// unsolicited data then fails the verification of the next echo instead.
+func RejectUnsolicitedData(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.rejectUnsolicited = enable
+		return nil
+	}
+}
+
+// ServeExtensions makes the service also handle inbound streams of the
+// TimestampID, TimestampExtID, SizedID and KeepaliveID protocols, on top of
+// ID. SizedID lets every peer pull payloads of up to MaxPayloadSize, so these
+// protocols are disabled by default, and peers pinging the service fall back
+// to ID.
+func ServeExtensions(enable bool) Option {
+	return func(ps *PingService) error {
+		ps.serveExtensions = enable
+		return nil
+	}
+}
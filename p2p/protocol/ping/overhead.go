@@ -0,0 +1,75 @@
+package ping
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// OverheadStats is the cost of the measured outbound rounds of the service
+// itself, as recorded with MeasureOverhead.
+type OverheadStats struct {
+	// Rounds is the number of successful measured rounds recorded.
+	Rounds int
+	// Processing is the total time spent in those rounds, excluding the
+	// wait for the echoes.
+	Processing time.Duration
+	// Allocs is the total number of heap allocations during those rounds.
+	// It is counted process-wide, so concurrent activity inflates it.
+	Allocs uint64
+}
+
+// overheadMeter records the OverheadStats of a service.
+type overheadMeter struct {
+	mx    sync.Mutex
+	stats OverheadStats
+}
+
+// overheadMark is the state at the start of a round.
+type overheadMark struct {
+	start  time.Time
+	allocs uint64
+}
+
+// readAllocs returns the number of heap allocations of the process so far.
+// Unlike runtime/metrics, runtime.ReadMemStats is exact, at the cost of
+// briefly stopping the world.
+func readAllocs() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Mallocs
+}
+
+// begin marks the start of a round. It is a no-op on a nil meter.
+func (m *overheadMeter) begin() overheadMark {
+	if m == nil {
+		return overheadMark{}
+	}
+	return overheadMark{start: time.Now(), allocs: readAllocs()}
+}
+
+// end records a round started at mark, that waited for its echo for wait.
+func (m *overheadMeter) end(mark overheadMark, wait time.Duration) {
+	if m == nil {
+		return
+	}
+	processing := time.Since(mark.start) - wait
+	allocs := readAllocs() - mark.allocs
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.stats.Rounds++
+	m.stats.Processing += processing
+	m.stats.Allocs += allocs
+}
+
+// Overhead returns the cost of the measured outbound rounds of the service
+// so far, if enabled with MeasureOverhead, and zero stats otherwise.
+func (ps *PingService) Overhead() OverheadStats {
+	if ps.overhead == nil {
+		return OverheadStats{}
+	}
+	ps.overhead.mx.Lock()
+	defer ps.overhead.mx.Unlock()
+	return ps.overhead.stats
+}
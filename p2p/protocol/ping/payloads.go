@@ -0,0 +1,60 @@
+package ping
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// payloadLog keeps the payloads of the last round to every peer, see
+// KeepLastPayloads.
+type payloadLog struct {
+	mx    sync.Mutex
+	peers map[peer.ID]*payloadPair
+}
+
+type payloadPair struct {
+	sent, received []byte
+}
+
+// keepPayloads records copies of the payload sent on s in the last round, and
+// of the echo received for it, if enabled with KeepLastPayloads. Rounds over
+// raw streams aren't recorded.
+func (ps *PingService) keepPayloads(s RawStream, sent, received []byte) {
+	ns, ok := s.(network.Stream)
+	if ps.payloads == nil || !ok {
+		return
+	}
+	p := ns.Conn().RemotePeer()
+	l := ps.payloads
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	pair, ok := l.peers[p]
+	if !ok {
+		pair = &payloadPair{}
+		l.peers[p] = pair
+	}
+	pair.sent = append(pair.sent[:0], sent...)
+	pair.received = append(pair.received[:0], received...)
+}
+
+// LastPayloads returns copies of the payload sent to p in the last outbound
+// round that read an echo, and of the echo, to debug payload mismatches. It
+// returns false if KeepLastPayloads isn't enabled, or if no echo was read
+// from p yet.
+func (ps *PingService) LastPayloads(p peer.ID) (sent, received []byte, ok bool) {
+	if ps.payloads == nil {
+		return nil, nil, false
+	}
+	l := ps.payloads
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	pair, ok := l.peers[p]
+	if !ok {
+		return nil, nil, false
+	}
+	return append([]byte(nil), pair.sent...), append([]byte(nil), pair.received...), true
+}
@@ -1,20 +1,20 @@
 package ping
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	mrand "math/rand"
+	"sync"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
 var log = logging.Logger("ping")
@@ -28,202 +28,478 @@ const (
 	ServiceName = "libp2p.ping"
 )
 
+// ErrHostNotReady is returned when a ping stream can't be opened and the host
+// isn't listening on any address yet, which usually means that the host was
+// used before it was started.
+var ErrHostNotReady = errors.New("host not ready: no listen addresses")
+
+// ErrRoundTimeout is returned when the peer doesn't answer a ping round in
+// time.
+var ErrRoundTimeout = errors.New("ping round timed out")
+
+// ErrEchoSlow and ErrStreamDead refine ErrRoundTimeout, which they wrap. A
+// round times out with ErrStreamDead if its connection was found closed, or
+// failed the probe set with LivenessProbe, and with ErrEchoSlow otherwise,
+// hinting at an overloaded peer rather than an unreachable one.
+var (
+	ErrEchoSlow   = fmt.Errorf("%w (stream alive, echo slow)", ErrRoundTimeout)
+	ErrStreamDead = fmt.Errorf("%w (stream dead)", ErrRoundTimeout)
+)
+
+// ErrRTTExceeded is returned for rounds that completed with an RTT above the
+// ceiling set with MaxAcceptableRTT.
+var ErrRTTExceeded = errors.New("ping RTT exceeded the acceptable maximum")
+
+// ErrUnsolicitedData is returned when the peer sent data on a ping stream
+// that wasn't the echo of a payload, see RejectUnsolicitedData.
+var ErrUnsolicitedData = errors.New("peer sent unsolicited data on ping stream")
+
+// ErrPingSelf is returned when pinging the host's own peer ID, unless the
+// AllowSelf option is set.
+var ErrPingSelf = errors.New("cannot ping self")
+
+// PingError is returned for failed ping attempts, identifying the peer and,
+// once a stream was opened, the connection the attempt failed on.
+type PingError struct {
+	Peer peer.ID
+	Conn network.Conn // nil if no stream could be opened
+	// Op is the failed operation: "open" for opening the stream, "round"
+	// for a ping round, and "keepalive" for an unmeasured round.
+	Op  string
+	Err error
+}
+
+func (e *PingError) Error() string {
+	if e.Conn != nil {
+		return fmt.Sprintf("ping %s %s on connection %s: %s", e.Op, e.Peer, e.Conn.ID(), e.Err)
+	}
+	return fmt.Sprintf("ping %s %s: %s", e.Op, e.Peer, e.Err)
+}
+
+func (e *PingError) Unwrap() error { return e.Err }
+
 type PingService struct {
-	Host    host.Host
-	timeout time.Duration
+	// accessed atomically, kept first for 64-bit alignment
+	inboundMemory int64
+	wireSeq       uint64 // last payload sequence number, see OnWire
+
+	Host host.Host
+	config
+
+	handlers []protocol.ID // registered by NewPingService
+
+	peersMx sync.Mutex
+	peers   map[peer.ID]*peerState
+
+	bgMx       sync.Mutex
+	background map[peer.ID]*bgSession
+}
+
+// config holds the settings of a PingService, as set with its options.
+type config struct {
+	timeout    time.Duration
+	timeoutSet bool // whether the timeout was set explicitly
+
+	measureLocalDelay bool
+	onResult          func(peer.ID, Result)
+	metricsTracer     MetricsTracer
+	storms            *stormDetector
+	outlierFactor     float64
+	reopenBackoff     time.Duration
+	batchSize         int
+	maxInboundMemory  int64
+	noEcho            bool
+	timestamps        bool
+	startDelay        time.Duration
+	count             int
+	duration          time.Duration
+	payloadSize       int
+	heartbeat         func()
+	alerts            *alertThresholds
+	alertEmitter      event.Emitter
+	freshStream       bool
+	noIdleTimeout     bool
+	onStreamEvent     func(StreamEvent)
+	verifyFunc        func(sent, received []byte) error
+	inboundFilter     func(peer.ID) bool
+	recordLatency     bool
+	manyConcurrency   int
+	allowSelf         bool
+	bucketWindow      time.Duration
+	loadStreams       int
+	loadRate          int
+	beforeStream      func(network.Stream) error
+	errorDedup        time.Duration
+	minSamples        int
+	rotateConns       bool
+	scoreReporter     func(peer.ID, float64)
+	lowLatency        bool
+	distinctPeers     *peerLimiter
+	reservePriority   uint8
+	measureEvery      int
+	dialRetries       int
+	dialBackoff       time.Duration
+	schedule          time.Duration
+	halfLife          time.Duration
+	noPool            bool
+	healthSink        func(peer.ID, bool)
+	healthyAfter      int
+	unhealthyAfter    int
+	tracer            Tracer
+	resetOnCancel     bool
+	dropRate          float64
+	onWire            func(WireEvent)
+	livenessProbe     time.Duration
+	continueFunc      func(Statistics) bool
+	skipFirstRecord   bool
+	maxRTT            time.Duration
+	extraIDs          []protocol.ID
+	rotateInterval    time.Duration
+	onHandlerTimeout  func(peer.ID)
+	dialTimeout       time.Duration
+	logs              *logThrottle
+	overhead          *overheadMeter
+	recordFilter      float64
+	handlerPool       *handlerPool
+	verifyMode        VerificationMode
+	payloads          *payloadLog
+	rejectUnsolicited bool
+	serveExtensions   bool
 }
 
-type Option func(*PingService) error
+// getBuf returns a buffer of n bytes, from the buffer pool unless disabled
+// with DisableBufferPool.
+func (ps *PingService) getBuf(n int) []byte {
+	if ps.noPool {
+		return make([]byte, n)
+	}
+	return pool.Get(n)
+}
 
-func Timeout(timeout time.Duration) Option {
-	return func(ps *PingService) error {
-		if timeout == 0 {
-			timeout = defaultTimeout
+// putBuf releases a buffer returned by getBuf. Without pooling, the buffer is
+// poisoned so that uses after its release are caught.
+func (ps *PingService) putBuf(b []byte) {
+	if ps.noPool {
+		for i := range b {
+			b[i] = 0xde
 		}
-		ps.timeout = timeout
-		return nil
+		return
 	}
+	pool.Put(b)
 }
 
 func NewPingService(h host.Host) *PingService {
-	ps := &PingService{h, defaultTimeout}
-	h.SetStreamHandler(ID, ps.PingHandler)
+	ps := newPingService(h)
+	ps.setHandler(ID, ps.PingHandler)
 	return ps
 }
 
+// setHandler registers a stream handler for the service, to be removed by
+// Close.
+func (ps *PingService) setHandler(id protocol.ID, handler network.StreamHandler) {
+	ps.Host.SetStreamHandler(id, handler)
+	ps.handlers = append(ps.handlers, id)
+}
+
+// Close removes the stream handlers registered by the service, including
+// those of AdditionalProtocolIDs, makes the HandlerPool reject streams that
+// weren't queued yet, and closes the emitter of the AlertThresholds alerts.
+// Outbound sessions keep running, without emitting alerts.
+func (ps *PingService) Close() error {
+	for _, id := range ps.handlers {
+		ps.Host.RemoveStreamHandler(id)
+	}
+	ps.handlers = nil
+	if ps.handlerPool != nil {
+		ps.handlerPool.close()
+	}
+	if ps.alertEmitter != nil {
+		// fails if already closed by a previous call
+		ps.alertEmitter.Close()
+	}
+	return nil
+}
+
+func newPingService(h host.Host) *PingService {
+	return &PingService{
+		Host: h,
+		config: config{
+			timeout:       defaultTimeout,
+			metricsTracer: nopMetricsTracer{},
+			recordLatency: true,
+			minSamples:    defaultMinSamples,
+
+			reservePriority: network.ReservationPriorityAlways,
+			healthyAfter:    defaultHealthyAfter,
+			unhealthyAfter:  defaultUnhealthyAfter,
+		},
+	}
+}
+
 func NewPingServiceWithOptions(h host.Host, opts ...Option) (*PingService, error) {
 	ps := NewPingService(h)
 	for _, o := range opts {
 		if err := o(ps); err != nil {
+			ps.Close()
 			return nil, err
 		}
 	}
+	for _, id := range ps.extraIDs {
+		ps.setHandler(id, ps.PingHandler)
+	}
+	if ps.serveExtensions {
+		ps.setHandler(TimestampID, ps.timestampHandler)
+		ps.setHandler(TimestampExtID, ps.timestampExtHandler)
+		ps.setHandler(SizedID, ps.sizedHandler)
+		ps.setHandler(KeepaliveID, ps.keepaliveHandler)
+	}
 	return ps, nil
 }
 
 func (p *PingService) PingHandler(s network.Stream) {
+	p.handle(s, PingSize, func(buf []byte) error {
+		return p.echo(s, buf, nil)
+	})
+}
+
+// handle serves an inbound ping stream, calling round for every ping round
+// until it fails. buf is a buffer of bufSize bytes reserved for the stream.
+// With a HandlerPool, the stream is served by the pool.
+func (p *PingService) handle(s network.Stream, bufSize int, round func(buf []byte) error) {
+	if !p.admit(s) {
+		s.Reset()
+		return
+	}
+	if p.handlerPool == nil {
+		p.serve(s, bufSize, round)
+		return
+	}
+	if !p.handlerPool.submit(func() { p.serve(s, bufSize, round) }) {
+		p.debugf(s.Conn().RemotePeer(), "rejecting ping stream from %s: handler pool saturated", s.Conn().RemotePeer())
+		p.metricsTracer.InboundStreamRejected("pool")
+		s.Reset()
+	}
+}
+
+// admit reports whether the inbound stream s passes the InboundFilter,
+// MaxDistinctPeers and StreamStormThreshold checks. They run before the
+// stream is queued to the HandlerPool, for rejected peers not to take its
+// slots.
+func (p *PingService) admit(s network.Stream) bool {
+	if p.inboundFilter != nil && !p.inboundFilter(s.Conn().RemotePeer()) {
+		p.debugf(s.Conn().RemotePeer(), "rejecting ping stream from %s: filtered", s.Conn().RemotePeer())
+		p.metricsTracer.InboundStreamRejected("filtered")
+		return false
+	}
+
+	if p.distinctPeers != nil && !p.distinctPeers.allow(s.Conn().RemotePeer(), time.Now()) {
+		p.debugf(s.Conn().RemotePeer(), "rejecting ping stream from %s: too many distinct peers", s.Conn().RemotePeer())
+		p.metricsTracer.InboundStreamRejected("distinct_peers")
+		return false
+	}
+	if p.storms != nil && !p.storms.allow(s.Conn().RemotePeer(), time.Now()) {
+		p.debugf(s.Conn().RemotePeer(), "rejecting ping stream from %s: too many streams", s.Conn().RemotePeer())
+		p.metricsTracer.InboundStreamRejected("storm")
+		return false
+	}
+	return true
+}
+
+// serve serves an inbound ping stream, see handle.
+func (p *PingService) serve(s network.Stream, bufSize int, round func(buf []byte) error) {
 	if err := s.Scope().SetService(ServiceName); err != nil {
 		log.Debugf("error attaching stream to ping service: %s", err)
 		s.Reset()
 		return
 	}
 
-	if err := s.Scope().ReserveMemory(PingSize, network.ReservationPriorityAlways); err != nil {
+	if !p.reserveInboundMemory(int64(bufSize)) {
+		p.debugf(s.Conn().RemotePeer(), "rejecting ping stream from %s: inbound memory limit reached", s.Conn().RemotePeer())
+		p.metricsTracer.InboundStreamRejected("memory")
+		s.Reset()
+		return
+	}
+	defer p.releaseInboundMemory(int64(bufSize))
+
+	if err := s.Scope().ReserveMemory(bufSize, p.reservePriority); err != nil {
 		log.Debugf("error reserving memory for ping stream: %s", err)
 		s.Reset()
 		return
 	}
-	defer s.Scope().ReleaseMemory(PingSize)
+	defer s.Scope().ReleaseMemory(bufSize)
 
-	buf := pool.Get(PingSize)
-	defer pool.Put(buf)
+	buf := p.getBuf(bufSize)
+	defer p.putBuf(buf)
 
-	errCh := make(chan error, 1)
-	defer close(errCh)
-	timer := time.NewTimer(p.timeout)
-	defer timer.Stop()
+	peer := s.Conn().RemotePeer()
+	err := p.serveRounds(buf, round, func() {
+		if p.onHandlerTimeout != nil {
+			p.onHandlerTimeout(peer)
+		}
+		s.Reset()
+	})
+	s.Reset()
+	p.debugf(peer, "%s", err)
+}
+
+// serveRounds calls round with buf until it fails, and returns the error. If
+// the peer goes idle for the timeout of the service, unless disabled with
+// NoIdleTimeout, the watchdog calls idle, which must make the round in
+// progress fail.
+func (p *PingService) serveRounds(buf []byte, round func(buf []byte) error, idle func()) error {
+	// The watchdog is tied to the loop's lifetime, so it never outlives the
+	// stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	watchdogDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-watchdogDone
+	}()
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if !p.noIdleTimeout {
+		timer = time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 
 	go func() {
+		defer close(watchdogDone)
 		select {
-		case <-timer.C:
+		case <-timeout:
 			if p.timeout < time.Second {
 				log.Debug("ping timeout (hint: timeout too short)")
 			} else {
 				log.Debug("ping timeout")
 			}
-		case err, ok := <-errCh:
-			if ok {
-				log.Debug(err)
-			} else {
-				log.Error("ping loop failed without error")
-			}
+			idle()
+		case <-ctx.Done():
 		}
-		s.Reset()
 	}()
 
 	for {
-		_, err := io.ReadFull(s, buf)
-		if err != nil {
-			errCh <- err
-			return
+		if err := round(buf); err != nil {
+			return err
 		}
 
-		_, err = s.Write(buf)
-		if err != nil {
-			errCh <- err
-			return
+		if timer != nil {
+			timer.Reset(p.timeout)
 		}
-
-		timer.Reset(p.timeout)
 	}
 }
 
-// Result is a result of a ping attempt, either an RTT or an error.
-type Result struct {
-	RTT   time.Duration
-	Error error
-}
-
-func (ps *PingService) Ping(ctx context.Context, p peer.ID) <-chan Result {
-	return Ping(ctx, ps.Host, p)
-}
-
-func pingError(err error) chan Result {
-	ch := make(chan Result, 1)
-	ch <- Result{Error: err}
-	close(ch)
-	return ch
-}
-
-// Ping pings the remote peer until the context is canceled, returning a stream
-// of RTTs or errors.
-func Ping(ctx context.Context, h host.Host, p peer.ID) <-chan Result {
-	s, err := h.NewStream(network.WithUseTransient(ctx, "ping"), p, ID)
-	if err != nil {
-		return pingError(err)
-	}
-
-	if err := s.Scope().SetService(ServiceName); err != nil {
-		log.Debugf("error attaching stream to ping service: %s", err)
-		s.Reset()
-		return pingError(err)
-	}
-
-	b := make([]byte, 8)
-	if _, err := rand.Read(b); err != nil {
-		log.Errorf("failed to get cryptographic random: %s", err)
-		s.Reset()
-		return pingError(err)
-	}
-	ra := mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(b))))
-
-	ctx, cancel := context.WithCancel(ctx)
-
-	out := make(chan Result)
-	go func() {
-		defer close(out)
-		defer cancel()
-
-		for ctx.Err() == nil {
-			var res Result
-			res.RTT, res.Error = ping(s, ra)
-
-			// canceled, ignore everything.
-			if ctx.Err() != nil {
-				return
-			}
-
-			// No error, record the RTT.
-			if res.Error == nil {
-				h.Peerstore().RecordLatency(p, res.RTT)
-			}
-
-			select {
-			case out <- res:
-			case <-ctx.Done():
-				return
+// maximum number of consecutive writes making no progress before writeFull
+// gives up
+const maxStalledWrites = 3
+
+// writeFull writes all of b to w. Some stream implementations return short
+// writes without an error, contrary to the io.Writer contract, so the
+// remainder is written by further calls, until too many make no progress.
+func writeFull(w io.Writer, b []byte) error {
+	stalled := 0
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			stalled++
+			if stalled == maxStalledWrites {
+				return io.ErrShortWrite
 			}
+			continue
 		}
-	}()
-	go func() {
-		// forces the ping to abort.
-		<-ctx.Done()
-		s.Reset()
-	}()
-
-	return out
+		stalled = 0
+		b = b[n:]
+	}
+	return nil
 }
 
-func ping(s network.Stream, randReader io.Reader) (time.Duration, error) {
-	if err := s.Scope().ReserveMemory(2*PingSize, network.ReservationPriorityAlways); err != nil {
-		log.Debugf("error reserving memory for ping stream: %s", err)
-		s.Reset()
-		return 0, err
+// echo reads a payload from s and answers it with buf, which starts with the
+// payload, with the remainder filled in by extend.
+func (p *PingService) echo(s io.ReadWriter, buf []byte, extend func(resp []byte, received time.Time)) error {
+	if _, err := io.ReadFull(s, buf[:PingSize]); err != nil {
+		return err
 	}
-	defer s.Scope().ReleaseMemory(2 * PingSize)
-
-	buf := pool.Get(PingSize)
-	defer pool.Put(buf)
-
-	if _, err := io.ReadFull(randReader, buf); err != nil {
-		return 0, err
+	if extend != nil {
+		extend(buf, time.Now())
 	}
 
-	before := time.Now()
-	if _, err := s.Write(buf); err != nil {
-		return 0, err
+	if !p.noEcho {
+		if err := writeFull(s, buf); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	rbuf := pool.Get(PingSize)
-	defer pool.Put(rbuf)
-
-	if _, err := io.ReadFull(s, rbuf); err != nil {
-		return 0, err
-	}
+// Result is a result of a ping attempt, either an RTT or an error.
+type Result struct {
+	// Time is when the ping attempt started.
+	Time  time.Time
+	RTT   time.Duration
+	Error error
 
-	if !bytes.Equal(buf, rbuf) {
-		return 0, errors.New("ping packet was incorrect")
-	}
+	// Tag is the session tag set with WithSessionTag, if any.
+	Tag any
+	// Dialed is set on the first result of a session if a new connection
+	// had to be dialed to open the ping stream. The RTT of such a round
+	// may be inflated by the connection setup.
+	Dialed bool
+	// Migrated is set on the first result over a stream that replaced one
+	// over a transient connection, once a direct connection to the peer was
+	// established, in resilient mode. Transport and Conn then describe the
+	// new path.
+	Migrated bool
+	// StreamOpen is the time it took to open and negotiate the stream the
+	// round was sent over. It is only set on the first round over every
+	// stream, which with FreshStreamPerRound is every round.
+	StreamOpen time.Duration
+	// Recorded is set if the RTT was recorded to the peerstore. RTTs are not
+	// recorded if the RecordLatency option disabled it, if the round went
+	// over a transient connection, for the first successful round of a
+	// session with SkipFirstLatencyRecord, or if RecordLatencyFilter deemed
+	// the RTT an outlier.
+	Recorded bool
+	// Transport is the transport of the connection the round went over, e.g.
+	// "tcp", "quic-v1" or "ws". Relayed connections are labeled "relay".
+	Transport string
+	// Conn is the ID of the connection the round went over.
+	Conn string
+	// ConnEvent is the most recent connection to the peer opened or closed
+	// during the session before a round failed, if any. It is only set on
+	// failed results.
+	ConnEvent *ConnEvent
+}
 
-	return time.Since(before), nil
+// DetailedResult is a Result augmented with a breakdown of where the time of
+// the round was spent. It helps telling local overhead apart from network delay.
+type DetailedResult struct {
+	Result
+
+	// WriteTime is the time between starting the round and the payload being
+	// handed to the stream. It is included in RTT.
+	WriteTime time.Duration
+	// WaitTime is the time between the payload being written and the echo
+	// being read.
+	WaitTime time.Duration
+	// SchedDelay is the time the pinging goroutine waited to be scheduled
+	// again after reading the echo. It is not included in RTT, and is only
+	// measured when the MeasureLocalDelay option is set.
+	SchedDelay time.Duration
+	// Direction is the direction of the connection the round went over.
+	Direction network.Direction
+
+	// OneWayDelay and ClockOffset are only set when timestamps were exchanged
+	// with the peer, see the ExchangeTimestamps option.
+	// OneWayDelay is the delay from us to the peer, which is only meaningful if
+	// the clocks of both nodes are synchronized.
+	OneWayDelay time.Duration
+	// ClockOffset is the estimated offset of the peer's clock to ours,
+	// assuming the network delay is symmetric.
+	ClockOffset time.Duration
+	// ServerProcessing is the time the peer spent between reading the payload
+	// and writing the echo. It is included in RTT, and only set if the peer
+	// supports TimestampExtID.
+	ServerProcessing time.Duration
 }
@@ -1,15 +1,37 @@
 package ping_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/test"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/ping/pb"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping/pingtest"
 
+	"github.com/libp2p/go-msgio/protoio"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
@@ -53,3 +75,2055 @@ func testPing(t *testing.T, ps *ping.PingService, p peer.ID) {
 	}
 
 }
+
+func connectedHosts(t *testing.T) (h1, h2 host.Host) {
+	h1, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h1.Close() })
+	h2, err = bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h2.Close() })
+
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	return h1, h2
+}
+
+func TestPingDetailed(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.MeasureLocalDelay(true))
+	require.NoError(t, err)
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := <-ps1.PingDetailed(ctx, h2.ID())
+	require.NoError(t, res.Error)
+	require.NotZero(t, res.RTT)
+	require.NotZero(t, res.SchedDelay)
+	require.LessOrEqual(t, res.WriteTime+res.WaitTime, res.RTT)
+}
+
+func TestPingSessionTag(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+
+	type tagged struct {
+		p   peer.ID
+		tag any
+	}
+	tags := make(chan tagged, 1)
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.OnResult(func(p peer.ID, res ping.Result) {
+		select {
+		case tags <- tagged{p, res.Tag}:
+		default:
+		}
+	}))
+	require.NoError(t, err)
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := <-ps1.Ping(ping.WithSessionTag(ctx, "task-1"), h2.ID())
+	require.NoError(t, res.Error)
+	require.Equal(t, "task-1", res.Tag)
+	require.Equal(t, tagged{h2.ID(), "task-1"}, <-tags)
+}
+
+func TestPingHostNotReady(t *testing.T) {
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDialOnly), nil)
+	require.NoError(t, err)
+	defer h.Close()
+	h2, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := <-ping.Ping(ctx, h, h2.ID())
+	require.ErrorIs(t, res.Error, ping.ErrHostNotReady)
+}
+
+func TestPingResilient(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.Resilient(10*time.Millisecond))
+	require.NoError(t, err)
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := ps1.Ping(ctx, h2.ID())
+	require.NoError(t, (<-results).Error)
+
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	var failed bool
+	for res := range results {
+		if res.Error != nil {
+			failed = true
+			continue
+		}
+		if failed {
+			// recovered on a new stream
+			return
+		}
+	}
+	t.Fatal("ping session didn't recover")
+}
+
+func TestPingConnEvent(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.Resilient(10*time.Millisecond))
+	require.NoError(t, err)
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := ps1.Ping(ctx, h2.ID())
+	res := <-results
+	require.NoError(t, res.Error)
+	require.Nil(t, res.ConnEvent)
+
+	// rounds keep failing, after the connection was closed
+	h2.RemoveStreamHandler(ping.ID)
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	for res := range results {
+		if res.Error == nil || res.ConnEvent == nil {
+			continue
+		}
+		require.NotEmpty(t, res.ConnEvent.Conn)
+		require.GreaterOrEqual(t, res.ConnEvent.Before, time.Duration(0))
+		require.Contains(t, res.ConnEvent.String(), "before the failure")
+		return
+	}
+	t.Fatal("no failure annotated with a connection event")
+}
+
+func TestPingHandlerNoGoroutineLeak(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+
+	for i := 0; i < 10; i++ {
+		s, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+		require.NoError(t, err)
+		buf := make([]byte, ping.PingSize)
+		_, err = s.Write(buf)
+		require.NoError(t, err)
+		_, err = io.ReadFull(s, buf)
+		require.NoError(t, err)
+		if i%2 == 0 {
+			s.Close()
+		} else {
+			s.Reset()
+		}
+	}
+
+	require.Eventually(t, func() bool { return handlerGoroutines() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// handlerGoroutines returns the number of goroutines serving inbound ping
+// streams, or watching them for idleness.
+func handlerGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	n := 0
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		// matches the serving goroutine, and its watchdog started by
+		// serveRounds
+		if bytes.Contains(g, []byte("ping.(*PingService).serve")) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPingBatch(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	psA, err := ping.NewPingServiceWithOptions(a, ping.BatchSize(8))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := psA.Ping(ctx, b.ID())
+	for i := 0; i < 3; i++ {
+		res := <-results
+		require.NoError(t, res.Error)
+		require.NotZero(t, res.RTT)
+	}
+}
+
+func TestPingDialed(t *testing.T) {
+	h1, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h2.Close()
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), time.Hour)
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := ping.Ping(ctx, h1, h2.ID())
+	res := <-results
+	require.NoError(t, res.Error)
+	require.True(t, res.Dialed)
+	res = <-results
+	require.NoError(t, res.Error)
+	require.False(t, res.Dialed)
+}
+
+func TestPingNoEcho(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	_, err := ping.NewPingServiceWithOptions(b, ping.NoEcho(true))
+	require.NoError(t, err)
+
+	s, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+	require.NoError(t, err)
+	defer s.Reset()
+	_, err = s.Write(make([]byte, ping.PingSize))
+	require.NoError(t, err)
+
+	echoed := make(chan struct{})
+	go func() {
+		if _, err := s.Read(make([]byte, 1)); err == nil {
+			close(echoed)
+		}
+	}()
+	select {
+	case <-echoed:
+		t.Fatal("payload was echoed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPingTimestamps(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	psA, err := ping.NewPingServiceWithOptions(a, ping.ExchangeTimestamps(true))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := <-psA.PingDetailed(ctx, b.ID())
+	require.NoError(t, res.Error)
+	// both nodes share the same clock
+	require.Greater(t, res.OneWayDelay, time.Duration(0))
+	require.Less(t, res.OneWayDelay, res.RTT)
+	require.Less(t, res.ClockOffset, res.RTT)
+	require.Greater(t, res.ClockOffset, -res.RTT)
+	require.Greater(t, res.ServerProcessing, time.Duration(0))
+	require.Less(t, res.ServerProcessing, res.RTT)
+
+	// peers only speaking the first version of the extension
+	b.RemoveStreamHandler(ping.TimestampExtID)
+	require.NoError(t, a.Peerstore().RemoveProtocols(b.ID(), ping.TimestampExtID))
+	res = <-psA.PingDetailed(ctx, b.ID())
+	require.NoError(t, res.Error)
+	require.Greater(t, res.OneWayDelay, time.Duration(0))
+	require.Zero(t, res.ServerProcessing)
+
+	// peers only speaking the base protocol are still supported
+	b.RemoveStreamHandler(ping.TimestampID)
+	require.NoError(t, a.Peerstore().RemoveProtocols(b.ID(), ping.TimestampID))
+	res = <-psA.PingDetailed(ctx, b.ID())
+	require.NoError(t, res.Error)
+	require.Zero(t, res.OneWayDelay)
+}
+
+func TestPingStartDelay(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	psA, err := ping.NewPingServiceWithOptions(a, ping.StartDelay(200*time.Millisecond))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, (<-psA.Ping(ctx, b.ID())).Error)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestPingBandwidthAccounting(t *testing.T) {
+	newHost := func(bwc metrics.Reporter) host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.BandwidthReporter(bwc))
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	bwc1 := metrics.NewBandwidthCounter()
+	h1 := newHost(bwc1)
+	bwc2 := metrics.NewBandwidthCounter()
+	h2 := newHost(bwc2)
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	const rounds = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	results := ping.Ping(ctx, h1, h2.ID())
+	for i := 0; i < rounds; i++ {
+		require.NoError(t, (<-results).Error)
+	}
+	cancel()
+
+	// Ping traffic is accounted under the ping protocol by the swarm.
+	require.Eventually(t, func() bool {
+		out := bwc1.GetBandwidthForProtocol(ping.ID)
+		in := bwc2.GetBandwidthForProtocol(ping.ID)
+		return out.TotalOut >= rounds*ping.PingSize && out.TotalIn >= rounds*ping.PingSize &&
+			in.TotalIn >= rounds*ping.PingSize && in.TotalOut >= rounds*ping.PingSize
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPingCountAndDuration(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+
+	count := func(results <-chan ping.Result) (n int) {
+		for res := range results {
+			require.NoError(t, res.Error)
+			n++
+		}
+		return n
+	}
+
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(5), ping.Duration(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 5, count(psA.Ping(context.Background(), b.ID())))
+
+	psA, err = ping.NewPingServiceWithOptions(a, ping.Count(1<<30), ping.Duration(100*time.Millisecond))
+	require.NoError(t, err)
+	start := time.Now()
+	require.NotZero(t, count(psA.Ping(context.Background(), b.ID())))
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPingPayloadSize(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	psA, err := ping.NewPingServiceWithOptions(a, ping.PayloadSize(1500), ping.Count(3))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+}
+
+func TestPingVerifyChecksum(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	_, err := ping.NewPingServiceWithOptions(a, ping.VerifyMode(42))
+	require.Error(t, err)
+	for _, size := range []int{3, 64 << 10} {
+		psA, err := ping.NewPingServiceWithOptions(a, ping.PayloadSize(size), ping.VerifyMode(ping.Checksum), ping.Count(3))
+		require.NoError(t, err)
+		for res := range psA.Ping(context.Background(), b.ID()) {
+			require.NoError(t, res.Error)
+		}
+	}
+}
+
+func TestDiagnoseVerifyChecksum(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	ps, err := ping.NewPingServiceWithOptions(a, ping.PayloadSize(64), ping.VerifyMode(ping.Checksum), ping.KeepLastPayloads(true))
+	require.NoError(t, err)
+	_, err = ps.Diagnose(context.Background(), b.ID(), 100*time.Millisecond)
+	require.NoError(t, err)
+
+	// the burst's payloads were sealed with their checksum
+	sent, _, ok := ps.LastPayloads(b.ID())
+	require.True(t, ok)
+	n := len(sent) - 4
+	require.Equal(t, crc32.Checksum(sent[:n], crc32.MakeTable(crc32.Castagnoli)), binary.BigEndian.Uint32(sent[n:]))
+}
+
+func TestLastPayloads(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(1))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	_, _, ok := psA.LastPayloads(b.ID())
+	require.False(t, ok)
+
+	psA, err = ping.NewPingServiceWithOptions(a, ping.Count(2), ping.PayloadSize(100), ping.KeepLastPayloads(true))
+	require.NoError(t, err)
+	_, _, ok = psA.LastPayloads(b.ID())
+	require.False(t, ok)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	sent, received, ok := psA.LastPayloads(b.ID())
+	require.True(t, ok)
+	require.Len(t, sent, 100)
+	require.Equal(t, sent, received)
+
+	// the returned buffers are copies
+	sent[0]++
+	again, _, _ := psA.LastPayloads(b.ID())
+	require.NotEqual(t, sent, again)
+}
+
+func TestProbeMTU(t *testing.T) {
+	// payloads above 2000 bytes exceed the handler's memory limit
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.MaxInboundMemory(2000), ping.ServeExtensions(true))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mtu, err := ping.ProbeMTU(ctx, a, b.ID(), 500, 4000, 500)
+	require.NoError(t, err)
+	require.Equal(t, 2000, mtu)
+
+	_, err = ping.ProbeMTU(ctx, a, b.ID(), 2500, 4000, 500)
+	require.Error(t, err)
+}
+
+func TestEstimateBDP(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	est, err := ping.NewPingService(a).MeasureBDP(ctx, b.ID())
+	require.NoError(t, err)
+	require.NotZero(t, est.RTT)
+	require.Greater(t, est.Throughput, 0.0)
+	require.Equal(t, int(est.Throughput*est.RTT.Seconds()), est.Bytes)
+
+	bdp, err := ping.EstimateBDP(ctx, a, b.ID())
+	require.NoError(t, err)
+	require.Greater(t, bdp, 0)
+}
+
+func TestPingHeartbeat(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var beats int32
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(3), ping.Heartbeat(func() { atomic.AddInt32(&beats, 1) }))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&beats))
+
+	// heartbeats are emitted for failed rounds too
+	b.RemoveStreamHandler(ping.ID)
+	atomic.StoreInt32(&beats, 0)
+	psA, err = ping.NewPingServiceWithOptions(a, ping.Count(3), ping.Resilient(time.Millisecond), ping.Heartbeat(func() { atomic.AddInt32(&beats, 1) }))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.Error(t, res.Error)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&beats))
+}
+
+func TestPingFreshStreamPerRound(t *testing.T) {
+	a, b, _, psB := pingtest.NewConnectedPair(t)
+	var streams int32
+	b.SetStreamHandler(ping.ID, func(s network.Stream) {
+		atomic.AddInt32(&streams, 1)
+		psB.PingHandler(s)
+	})
+
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(3), ping.FreshStreamPerRound(true))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		require.NotZero(t, res.StreamOpen)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&streams))
+
+	// by default, the stream is reused and negotiation is only reported once
+	atomic.StoreInt32(&streams, 0)
+	psA, err = ping.NewPingServiceWithOptions(a, ping.Count(3))
+	require.NoError(t, err)
+	var opens int
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		if res.StreamOpen > 0 {
+			opens++
+		}
+	}
+	require.Equal(t, 1, opens)
+	require.Equal(t, int32(1), atomic.LoadInt32(&streams))
+}
+
+func TestPingNoIdleTimeout(t *testing.T) {
+	roundTrip := func(s network.Stream) error {
+		buf := make([]byte, ping.PingSize)
+		if _, err := s.Write(buf); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(s, buf)
+		return err
+	}
+
+	for _, disable := range []bool{false, true} {
+		a, b, _, _ := pingtest.NewConnectedPair(t, ping.Timeout(50*time.Millisecond), ping.NoIdleTimeout(disable))
+		s, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+		require.NoError(t, err)
+		require.NoError(t, roundTrip(s))
+		time.Sleep(200 * time.Millisecond)
+		if disable {
+			require.NoError(t, roundTrip(s))
+		} else {
+			require.Error(t, roundTrip(s))
+		}
+		s.Reset()
+	}
+}
+
+func TestPingOnHandlerTimeout(t *testing.T) {
+	timedOut := make(chan peer.ID, 2)
+	a, b, _, _ := pingtest.NewConnectedPair(t,
+		ping.Timeout(50*time.Millisecond),
+		ping.OnHandlerTimeout(func(p peer.ID) { timedOut <- p }),
+	)
+	s, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+	require.NoError(t, err)
+	defer s.Reset()
+	// the first write completes the protocol negotiation, but no payload
+	_, err = s.Write([]byte{0})
+	require.NoError(t, err)
+
+	select {
+	case p := <-timedOut:
+		require.Equal(t, a.ID(), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler timeout not reported")
+	}
+	// reported once per stream
+	time.Sleep(200 * time.Millisecond)
+	require.Empty(t, timedOut)
+}
+
+func TestCollect(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	st, err := ping.Collect(context.Background(), a, b.ID(), 5)
+	require.NoError(t, err)
+	require.Equal(t, 5, st.Sent)
+	require.Equal(t, 5, st.Received)
+	require.Zero(t, st.Loss)
+	require.NotZero(t, st.Mean)
+	require.LessOrEqual(t, st.Min, st.Mean)
+	require.LessOrEqual(t, st.Mean, st.Max)
+
+	_, err = ping.Collect(context.Background(), a, b.ID(), 0)
+	require.Error(t, err)
+}
+
+func TestWaitStable(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	st, err := ping.WaitStable(context.Background(), a, b.ID(), 3, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 3, st.Received)
+	require.LessOrEqual(t, st.StdDev, time.Second)
+
+	// a threshold that can never be met
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = ping.WaitStable(ctx, a, b.ID(), 3, -1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = ping.WaitStable(context.Background(), a, b.ID(), 1, time.Second)
+	require.Error(t, err)
+}
+
+func TestWaitForRTT(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	rtt, err := ping.WaitForRTT(context.Background(), a, b.ID(), time.Second)
+	require.NoError(t, err)
+	require.NotZero(t, rtt)
+	require.LessOrEqual(t, rtt, time.Second)
+
+	// a target that can never be met
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	rtt, err = ping.WaitForRTT(ctx, a, b.ID(), -1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotZero(t, rtt)
+}
+
+func TestDiagnose(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	// a monitor measuring rarely
+	ps, err := ping.NewPingServiceWithOptions(a,
+		ping.Schedule(time.Hour),
+		ping.ReservationPriority(network.ReservationPriorityLow),
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	monitor := ps.Ping(ctx, b.ID())
+
+	st, err := ps.Diagnose(context.Background(), b.ID(), 200*time.Millisecond)
+	require.NoError(t, err)
+	require.Greater(t, st.Received, 3)
+	require.Zero(t, st.Loss)
+	require.NotZero(t, st.P50)
+
+	// the monitor is unaffected
+	require.Equal(t, []peer.ID{b.ID()}, ps.ActivePeers())
+	cancel()
+	for range monitor {
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ps.Diagnose(canceled, b.ID(), time.Second)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDiagnoseFreshStream(t *testing.T) {
+	a, b, _, psB := pingtest.NewConnectedPair(t)
+	var streams int32
+	b.SetStreamHandler(ping.ID, func(s network.Stream) {
+		atomic.AddInt32(&streams, 1)
+		psB.PingHandler(s)
+	})
+	ps, err := ping.NewPingServiceWithOptions(a, ping.FreshStreamPerRound(true))
+	require.NoError(t, err)
+
+	st, err := ps.Diagnose(context.Background(), b.ID(), 200*time.Millisecond)
+	require.NoError(t, err)
+	require.Greater(t, st.Received, 3)
+	// every round went over a new stream
+	require.GreaterOrEqual(t, int(atomic.LoadInt32(&streams)), st.Sent)
+}
+
+func TestPingStreamEvents(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	events := make(chan ping.StreamEvent, 100)
+	ps1, err := ping.NewPingServiceWithOptions(h1,
+		ping.Resilient(10*time.Millisecond),
+		ping.OnStreamEvent(func(evt ping.StreamEvent) {
+			select {
+			case events <- evt:
+			default:
+			}
+		}),
+	)
+	require.NoError(t, err)
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := ps1.Ping(ctx, h2.ID())
+	require.NoError(t, (<-results).Error)
+	evt := <-events
+	require.Equal(t, ping.StreamOpened, evt.Kind)
+	require.Equal(t, h2.ID(), evt.Peer)
+
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	for res := range results {
+		if res.Error != nil {
+			break
+		}
+	}
+	evt = <-events
+	require.Equal(t, ping.StreamReset, evt.Kind)
+	require.Error(t, evt.Err)
+	go func() {
+		for range results {
+		}
+	}()
+	for {
+		select {
+		case evt = <-events:
+			if evt.Kind == ping.StreamReopened {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("ping stream wasn't reopened")
+		}
+	}
+}
+
+func TestPingVerifyFunc(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	errRewritten := errors.New("payload rewritten")
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(1), ping.VerifyFunc(func(sent, received []byte) error {
+		if !bytes.Equal(sent, received) {
+			return errors.New("unexpected mismatch")
+		}
+		return errRewritten
+	}))
+	require.NoError(t, err)
+	res := <-psA.Ping(context.Background(), b.ID())
+	require.Error(t, res.Error)
+	require.Contains(t, res.Error.Error(), errRewritten.Error())
+}
+
+func TestPingInboundFilter(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.InboundFilter(func(p peer.ID) bool { return false }))
+	res := <-ping.Ping(context.Background(), a, b.ID())
+	require.Error(t, res.Error)
+
+	a, b, _, _ = pingtest.NewConnectedPair(t, ping.InboundFilter(func(p peer.ID) bool { return p == a.ID() }))
+	res = <-ping.Ping(context.Background(), a, b.ID())
+	require.NoError(t, res.Error)
+}
+
+func TestPingRecordLatency(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(1), ping.RecordLatency(false))
+	require.NoError(t, err)
+	res := <-psA.Ping(context.Background(), b.ID())
+	require.NoError(t, res.Error)
+	require.False(t, res.Recorded)
+	require.Zero(t, a.Peerstore().LatencyEWMA(b.ID()))
+
+	res = <-ping.Ping(context.Background(), a, b.ID())
+	require.NoError(t, res.Error)
+	require.True(t, res.Recorded)
+	require.NotZero(t, a.Peerstore().LatencyEWMA(b.ID()))
+}
+
+func TestPingSkipFirstLatencyRecord(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(1), ping.SkipFirstLatencyRecord(true))
+	require.NoError(t, err)
+	res := <-psA.Ping(context.Background(), b.ID())
+	require.NoError(t, res.Error)
+	require.False(t, res.Recorded)
+	require.Zero(t, a.Peerstore().LatencyEWMA(b.ID()))
+
+	psA, err = ping.NewPingServiceWithOptions(a, ping.Count(2), ping.SkipFirstLatencyRecord(true))
+	require.NoError(t, err)
+	var recorded []bool
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		recorded = append(recorded, res.Recorded)
+	}
+	require.Equal(t, []bool{false, true}, recorded)
+	require.NotZero(t, a.Peerstore().LatencyEWMA(b.ID()))
+}
+
+func TestPingMany(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h2)
+	h3, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h3.Close() })
+	ping.NewPingService(h3)
+	// h3 is not connected yet, and gets dialed before the measurements
+	h1.Peerstore().AddAddrs(h3.ID(), h3.Addrs(), peerstore.PermanentAddrTTL)
+	unknown := test.RandPeerIDFatal(t)
+
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.ManyConcurrency(2))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := ps1.PingMany(ctx, []peer.ID{h2.ID(), h3.ID(), unknown}, 3)
+	require.Len(t, results, 3)
+	for _, p := range []peer.ID{h2.ID(), h3.ID()} {
+		require.NoError(t, results[p].DialError)
+		require.NoError(t, results[p].Error)
+		require.Equal(t, 3, results[p].Received)
+	}
+	require.Error(t, results[unknown].DialError)
+	require.Zero(t, results[unknown].Sent)
+}
+
+func TestCompare(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h2)
+	h3, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h3.Close() })
+	ping.NewPingService(h3)
+	h1.Peerstore().AddAddrs(h3.ID(), h3.Addrs(), peerstore.PermanentAddrTTL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	faster, st2, st3, err := ping.Compare(ctx, h1, h2.ID(), h3.ID(), 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, st2.Received)
+	require.Equal(t, 3, st3.Received)
+	if st3.P50 < st2.P50 {
+		require.Equal(t, h3.ID(), faster)
+	} else {
+		require.Equal(t, h2.ID(), faster)
+	}
+
+	// an unreachable peer is never faster
+	unknown := test.RandPeerIDFatal(t)
+	faster, _, stUnknown, err := ping.Compare(ctx, h1, h2.ID(), unknown, 3)
+	require.NoError(t, err)
+	require.Equal(t, h2.ID(), faster)
+	require.Zero(t, stUnknown.Received)
+
+	_, _, _, err = ping.Compare(ctx, h1, unknown, test.RandPeerIDFatal(t), 3)
+	require.Error(t, err)
+}
+
+func TestStreamProto(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ping.StreamProto(ctx, a, b.ID(), pw)
+		pw.Close()
+	}()
+
+	rd := protoio.NewDelimitedReader(pr, 1024)
+	for i := 0; i < 3; i++ {
+		var msg pb.Result
+		require.NoError(t, rd.ReadMsg(&msg))
+		require.Equal(t, []byte(b.ID()), msg.Peer)
+		require.Equal(t, uint64(i), msg.GetSeq())
+		require.NotZero(t, msg.GetRtt())
+		require.NotZero(t, msg.GetTime())
+		require.Nil(t, msg.Error)
+	}
+	cancel()
+	go io.Copy(io.Discard, pr)
+	require.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestPingSelf(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	res := <-ping.Ping(context.Background(), a, a.ID())
+	require.ErrorIs(t, res.Error, ping.ErrPingSelf)
+	require.ErrorIs(t, ping.PingOnce(context.Background(), a, a.ID()).Error, ping.ErrPingSelf)
+
+	psA, err := ping.NewPingServiceWithOptions(a, ping.AllowSelf(true))
+	require.NoError(t, err)
+	res = psA.PingOnce(context.Background(), a.ID())
+	require.Error(t, res.Error)
+	require.NotErrorIs(t, res.Error, ping.ErrPingSelf)
+
+	require.NoError(t, ping.PingOnce(context.Background(), a, b.ID()).Error)
+}
+
+func TestBucketedResults(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	psA, err := ping.NewPingServiceWithOptions(a, ping.BucketBy(100*time.Millisecond), ping.Duration(250*time.Millisecond))
+	require.NoError(t, err)
+
+	var windows []ping.WindowStat
+	for w := range psA.BucketedResults(context.Background(), b.ID()) {
+		windows = append(windows, w)
+	}
+	require.Len(t, windows, 3)
+	for i, w := range windows {
+		require.NotZero(t, w.Count)
+		require.Zero(t, w.Errors)
+		require.LessOrEqual(t, w.Min, w.Avg)
+		require.LessOrEqual(t, w.Avg, w.Max)
+		require.Equal(t, i == 2, w.Partial)
+	}
+	require.Less(t, windows[2].Duration, 100*time.Millisecond)
+}
+
+func TestPingConcurrentLoad(t *testing.T) {
+	a, b, _, psB := pingtest.NewConnectedPair(t)
+	var streams int32
+	b.SetStreamHandler(ping.ID, func(s network.Stream) {
+		atomic.AddInt32(&streams, 1)
+		psB.PingHandler(s)
+	})
+
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Duration(200*time.Millisecond), ping.ConcurrentLoad(3, 0))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&streams) == 4 }, 5*time.Second, 10*time.Millisecond)
+	// the noise streams are cleaned up with the session
+	require.Eventually(t, func() bool { return handlerGoroutines() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPingBeforeStream(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var calls int32
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(2), ping.BeforeStream(func(s network.Stream) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	errVeto := errors.New("vetoed")
+	psA, err = ping.NewPingServiceWithOptions(a, ping.BeforeStream(func(network.Stream) error { return errVeto }))
+	require.NoError(t, err)
+	res := psA.PingOnce(context.Background(), b.ID())
+	require.ErrorIs(t, res.Error, errVeto)
+}
+
+func TestCollectMinSamples(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	st, err := ping.Collect(context.Background(), a, b.ID(), 2)
+	require.ErrorIs(t, err, ping.ErrInsufficientSamples)
+	require.Equal(t, 2, st.Received)
+
+	psA, err := ping.NewPingServiceWithOptions(a, ping.MinSamples(2))
+	require.NoError(t, err)
+	_, err = psA.Collect(context.Background(), b.ID(), 2)
+	require.NoError(t, err)
+}
+
+func TestPingTransport(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h2)
+	res := ping.PingOnce(context.Background(), h1, h2.ID())
+	require.NoError(t, res.Error)
+	require.NotEmpty(t, res.Transport)
+	require.Contains(t, []string{"tcp", "quic", "quic-v1"}, res.Transport)
+}
+
+func TestPingDetailedOnce(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h2)
+	res, err := ping.PingDetailedOnce(context.Background(), h1, h2.ID())
+	require.NoError(t, err)
+	require.NotZero(t, res.RTT)
+	require.NotZero(t, res.WaitTime)
+	require.NotEmpty(t, res.Transport)
+	require.Equal(t, network.DirOutbound, res.Direction)
+	require.False(t, res.Dialed)
+	require.Eventually(t, func() bool {
+		for _, c := range h1.Network().ConnsToPeer(h2.ID()) {
+			if len(c.GetStreams()) > 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ping.PingDetailedOnce(ctx, h1, h2.ID())
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPingRotateConnections(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	// with a single connection, it is used for every round
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(2), ping.RotateConnections(true))
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		require.Equal(t, a.Network().ConnsToPeer(b.ID())[0].ID(), res.Conn)
+	}
+
+}
+
+func TestPingScoreReporter(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var score int64
+	report := ping.ScoreReporter(func(p peer.ID, delta float64) {
+		if p == b.ID() {
+			atomic.AddInt64(&score, int64(delta))
+		}
+	})
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Count(3), report)
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	require.Equal(t, int64(3), atomic.LoadInt64(&score))
+
+	b.RemoveStreamHandler(ping.ID)
+	psA, err = ping.NewPingServiceWithOptions(a, ping.Count(2), ping.Resilient(time.Millisecond), report)
+	require.NoError(t, err)
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		require.Error(t, res.Error)
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&score))
+}
+
+func TestActivePeers(t *testing.T) {
+	_, b, psA, _ := pingtest.NewConnectedPair(t)
+	require.Empty(t, psA.ActivePeers())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := psA.Ping(ctx, b.ID())
+	require.NoError(t, (<-results).Error)
+	require.Equal(t, []peer.ID{b.ID()}, psA.ActivePeers())
+
+	cancel()
+	for range results {
+	}
+	require.Empty(t, psA.ActivePeers())
+}
+
+func TestPingResyncOnMismatch(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var rounds int32
+	events := make(chan ping.StreamEvent, 10)
+	psA, err := ping.NewPingServiceWithOptions(a,
+		ping.Count(3),
+		ping.Resilient(time.Millisecond),
+		ping.VerifyFunc(func(sent, received []byte) error {
+			if atomic.AddInt32(&rounds, 1) == 1 {
+				return errors.New("corrupted")
+			}
+			return nil
+		}),
+		ping.OnStreamEvent(func(evt ping.StreamEvent) { events <- evt }),
+	)
+	require.NoError(t, err)
+
+	var errs int
+	for res := range psA.Ping(context.Background(), b.ID()) {
+		if res.Error != nil {
+			errs++
+		}
+	}
+	require.Equal(t, 1, errs)
+	close(events)
+	var kinds []ping.StreamEventKind
+	for evt := range events {
+		kinds = append(kinds, evt.Kind)
+	}
+	require.Equal(t, []ping.StreamEventKind{ping.StreamOpened, ping.StreamReset, ping.StreamResynced}, kinds)
+}
+
+func TestPingRoundTimeout(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.NoEcho(true))
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Timeout(100*time.Millisecond))
+	require.NoError(t, err)
+	start := time.Now()
+	res := psA.PingOnce(context.Background(), b.ID())
+	require.ErrorIs(t, res.Error, ping.ErrRoundTimeout)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// without an explicit timeout, rounds are bounded by the context deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = ping.PingDetailedOnce(ctx, a, b.ID())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPingMeasureEvery(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	_, err := ping.NewPingServiceWithOptions(a, ping.MeasureEvery(0))
+	require.Error(t, err)
+
+	var rounds, verified int32
+	psA, err := ping.NewPingServiceWithOptions(a,
+		ping.MeasureEvery(3),
+		ping.Heartbeat(func() { atomic.AddInt32(&rounds, 1) }),
+		ping.VerifyFunc(func(sent, received []byte) error {
+			atomic.AddInt32(&verified, 1)
+			if !bytes.Equal(sent, received) {
+				return errors.New("mismatch")
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := psA.Ping(ctx, b.ID())
+	for i := 0; i < 3; i++ {
+		res := <-results
+		require.NoError(t, res.Error)
+		require.NotZero(t, res.RTT)
+	}
+	// two keepalive rounds run between measured ones
+	require.GreaterOrEqual(t, atomic.LoadInt32(&rounds), int32(7))
+	require.LessOrEqual(t, atomic.LoadInt32(&verified), int32(4))
+	cancel()
+	for range results {
+	}
+}
+
+func TestPingError(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.NoEcho(true))
+	psA, err := ping.NewPingServiceWithOptions(a, ping.Timeout(100*time.Millisecond))
+	require.NoError(t, err)
+
+	res := psA.PingOnce(context.Background(), b.ID())
+	var perr *ping.PingError
+	require.ErrorAs(t, res.Error, &perr)
+	require.Equal(t, b.ID(), perr.Peer)
+	require.Equal(t, "round", perr.Op)
+	require.NotNil(t, perr.Conn)
+	require.Equal(t, res.Conn, perr.Conn.ID())
+	require.ErrorIs(t, res.Error, ping.ErrRoundTimeout)
+
+	// failing to open a stream
+	unknown := test.RandPeerIDFatal(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res = psA.PingOnce(ctx, unknown)
+	require.ErrorAs(t, res.Error, &perr)
+	require.Equal(t, unknown, perr.Peer)
+	require.Equal(t, "open", perr.Op)
+	require.Nil(t, perr.Conn)
+}
+
+func TestPingDialRetries(t *testing.T) {
+	h1, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h2.Close()
+	ping.NewPingService(h2)
+
+	_, err = ping.NewPingServiceWithOptions(h1, ping.DialRetries(-1, 0))
+	require.Error(t, err)
+
+	// without retries, the ping fails right away as h2's address is unknown
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Error(t, ping.PingOnce(ctx, h1, h2.ID()).Error)
+
+	// the address becomes known while retrying
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.DialRetries(20, 50*time.Millisecond))
+	require.NoError(t, err)
+	time.AfterFunc(100*time.Millisecond, func() {
+		h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.PermanentAddrTTL)
+	})
+	require.NoError(t, ps1.PingOnce(ctx, h2.ID()).Error)
+
+	// retries stop when the context is done
+	h3, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h3.Close()
+	ps1, err = ping.NewPingServiceWithOptions(h1, ping.DialRetries(1000, 50*time.Millisecond))
+	require.NoError(t, err)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer shortCancel()
+	start := time.Now()
+	require.Error(t, ps1.PingOnce(shortCtx, h3.ID()).Error)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPingAllAddrs(t *testing.T) {
+	h1, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h2.Close()
+	ping.NewPingService(h2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs := h2.Addrs()
+	require.GreaterOrEqual(t, len(addrs), 2)
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: addrs[:1]}))
+	h1.Peerstore().AddAddrs(h2.ID(), addrs, peerstore.PermanentAddrTTL)
+	unreachable := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+	h1.Peerstore().AddAddr(h2.ID(), unreachable, peerstore.PermanentAddrTTL)
+
+	results := ping.PingAllAddrs(ctx, h1, h2.ID())
+	require.Len(t, results, len(addrs)+1)
+	for addr, res := range results {
+		if addr.Equal(unreachable) {
+			var perr *ping.PingError
+			require.ErrorAs(t, res.Error, &perr)
+			require.Equal(t, "open", perr.Op)
+			continue
+		}
+		require.NoError(t, res.Error, addr)
+		require.NotZero(t, res.RTT, addr)
+		require.NotZero(t, res.StreamOpen, addr)
+		// the existing connection is reused
+		require.Equal(t, !addr.Equal(addrs[0]), res.Dialed, addr)
+	}
+
+	// the probe connections are closed, the existing one is left open
+	require.Eventually(t, func() bool { return len(h1.Network().ConnsToPeer(h2.ID())) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, h1.Network().ConnsToPeer(h2.ID())[0].RemoteMultiaddr().Equal(addrs[0]))
+}
+
+type streamOpenTracer struct {
+	ping.MetricsTracer
+	opened chan time.Duration
+}
+
+func (t streamOpenTracer) StreamOpenTime(_ string, d time.Duration) { t.opened <- d }
+
+func TestPingStreamOpenMetric(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	tracer := streamOpenTracer{MetricsTracer: ping.NewMetricsTracer(), opened: make(chan time.Duration, 16)}
+	ps, err := ping.NewPingServiceWithOptions(a,
+		ping.WithMetricsTracer(tracer),
+		ping.FreshStreamPerRound(true),
+		ping.Count(3),
+	)
+	require.NoError(t, err)
+
+	var opened []time.Duration
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		opened = append(opened, res.StreamOpen)
+	}
+	require.Len(t, opened, 3)
+	for _, d := range opened {
+		require.Equal(t, d, <-tracer.opened)
+	}
+}
+
+func TestPingCanceledContext(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var opened int32
+	ps, err := ping.NewPingServiceWithOptions(a, ping.BeforeStream(func(network.Stream) error {
+		atomic.AddInt32(&opened, 1)
+		return nil
+	}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var n int
+	for res := range ps.Ping(ctx, b.ID()) {
+		require.ErrorIs(t, res.Error, context.Canceled)
+		n++
+	}
+	require.Equal(t, 1, n)
+	require.ErrorIs(t, ps.PingOnce(ctx, b.ID()).Error, context.Canceled)
+	_, err = ps.PingDetailedOnce(ctx, b.ID())
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, atomic.LoadInt32(&opened))
+}
+
+func TestPingSchedule(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	_, err := ping.NewPingServiceWithOptions(a, ping.Schedule(-time.Second))
+	require.Error(t, err)
+
+	const align = 100 * time.Millisecond
+	ps, err := ping.NewPingServiceWithOptions(a, ping.Schedule(align), ping.Count(3))
+	require.NoError(t, err)
+	var last time.Time
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		require.Less(t, res.Time.Sub(res.Time.Truncate(align)), align/2)
+		if !last.IsZero() {
+			require.GreaterOrEqual(t, res.Time.Sub(last), align/2)
+		}
+		last = res.Time
+	}
+}
+
+func TestLastError(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	ps := ping.NewPingService(a)
+	require.ErrorIs(t, ps.LastError(b.ID()), ping.ErrNoSession)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := ps.Ping(ctx, b.ID())
+	require.NoError(t, (<-results).Error)
+	require.NoError(t, ps.LastError(b.ID()))
+	cancel()
+	for range results {
+	}
+	require.ErrorIs(t, ps.LastError(b.ID()), ping.ErrNoSession)
+
+	// rounds to a peer that doesn't echo time out
+	c, d, _, _ := pingtest.NewConnectedPair(t, ping.NoEcho(true))
+	ps, err := ping.NewPingServiceWithOptions(c, ping.Timeout(50*time.Millisecond), ping.Resilient(time.Millisecond))
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	results = ps.Ping(ctx, d.ID())
+	require.Error(t, (<-results).Error)
+	require.ErrorIs(t, ps.LastError(d.ID()), ping.ErrRoundTimeout)
+	cancel()
+	for range results {
+	}
+}
+
+func TestPingDisableBufferPool(t *testing.T) {
+	for name, opts := range map[string][]ping.Option{
+		"plain":      nil,
+		"batch":      {ping.BatchSize(4)},
+		"sized":      {ping.PayloadSize(1024)},
+		"timestamps": {ping.ExchangeTimestamps(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := append([]ping.Option{ping.DisableBufferPool(true), ping.Count(3), ping.ServeExtensions(true)}, opts...)
+			_, b, psA, _ := pingtest.NewConnectedPair(t, opts...)
+			var n int
+			for res := range psA.Ping(context.Background(), b.ID()) {
+				require.NoError(t, res.Error)
+				n++
+			}
+			require.Equal(t, 3, n)
+		})
+	}
+}
+
+func TestSessionBytes(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var rounds int32
+	ps, err := ping.NewPingServiceWithOptions(a,
+		ping.Resilient(time.Millisecond),
+		ping.VerifyFunc(func(sent, received []byte) error {
+			// fail the first round to force a stream reopen
+			if atomic.AddInt32(&rounds, 1) == 1 {
+				return errors.New("corrupted")
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := ps.Ping(ctx, b.ID())
+	require.Error(t, (<-results).Error)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, (<-results).Error)
+	}
+	sent, recv := ps.SessionBytes(b.ID())
+	require.GreaterOrEqual(t, sent, int64(4*ping.PingSize))
+	require.GreaterOrEqual(t, recv, int64(4*ping.PingSize))
+
+	cancel()
+	for range results {
+	}
+	sent, recv = ps.SessionBytes(b.ID())
+	require.Zero(t, sent)
+	require.Zero(t, recv)
+}
+
+type roundTracer chan ping.RoundSpan
+
+func (t roundTracer) Round(_ context.Context, span ping.RoundSpan) { t <- span }
+
+func TestPingTracer(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	tracer := make(roundTracer, 16)
+	ps, err := ping.NewPingServiceWithOptions(a, ping.WithTracer(tracer), ping.Count(3))
+	require.NoError(t, err)
+
+	var results []ping.Result
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		results = append(results, res)
+	}
+	require.Len(t, results, 3)
+	for _, res := range results {
+		span := <-tracer
+		require.Equal(t, b.ID(), span.Peer)
+		require.Equal(t, res.RTT, span.RTT)
+		require.Equal(t, res.Transport, span.Transport)
+		require.NoError(t, span.Err)
+		require.Equal(t, span.RTT, span.End.Sub(span.Start))
+		require.False(t, span.Start.Before(res.Time))
+	}
+
+	// failed rounds are traced with their error
+	c, d, _, _ := pingtest.NewConnectedPair(t, ping.NoEcho(true))
+	ps, err = ping.NewPingServiceWithOptions(c, ping.WithTracer(tracer), ping.Timeout(50*time.Millisecond))
+	require.NoError(t, err)
+	_, err = ps.PingDetailedOnce(context.Background(), d.ID())
+	require.Error(t, err)
+	span := <-tracer
+	require.ErrorIs(t, span.Err, ping.ErrRoundTimeout)
+}
+
+func TestPingUnsolicitedData(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	// a server that sends a byte after every echo
+	h2.SetStreamHandler(ping.ID, func(s network.Stream) {
+		defer s.Close()
+		buf := make([]byte, ping.PingSize)
+		for {
+			if _, err := io.ReadFull(s, buf); err != nil {
+				return
+			}
+			if _, err := s.Write(append(buf, 0)); err != nil {
+				return
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ps, err := ping.NewPingServiceWithOptions(h1, ping.RejectUnsolicitedData(true))
+	require.NoError(t, err)
+	results := ps.Ping(ctx, h2.ID())
+	require.NoError(t, (<-results).Error)
+	require.ErrorIs(t, (<-results).Error, ping.ErrUnsolicitedData)
+	cancel()
+	for range results {
+	}
+
+	// without the check, the data fails the next round's verification
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results = ping.NewPingService(h1).Ping(ctx, h2.ID())
+	require.NoError(t, (<-results).Error)
+	require.Error(t, (<-results).Error)
+	cancel()
+	for range results {
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	var opened int32
+	var protos []protocol.ID
+	psA, err := ping.NewPingServiceWithOptions(a, ping.BeforeStream(func(s network.Stream) error {
+		atomic.AddInt32(&opened, 1)
+		protos = append(protos, s.Protocol())
+		return nil
+	}))
+	require.NoError(t, err)
+	require.ErrorIs(t, psA.Keepalive(ctx, b.ID(), 10*time.Millisecond), context.DeadlineExceeded)
+	require.Equal(t, int32(1), atomic.LoadInt32(&opened))
+	require.Equal(t, []protocol.ID{ping.KeepaliveID}, protos)
+
+	require.Error(t, psA.Keepalive(context.Background(), b.ID(), 0))
+
+	// a peer that doesn't echo
+	c, d, _, _ := pingtest.NewConnectedPair(t, ping.NoEcho(true), ping.ServeExtensions(true))
+	psC, err := ping.NewPingServiceWithOptions(c, ping.Timeout(50*time.Millisecond))
+	require.NoError(t, err)
+	require.ErrorIs(t, psC.Keepalive(context.Background(), d.ID(), time.Millisecond), ping.ErrRoundTimeout)
+}
+
+func TestKeepaliveFallback(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.ServeExtensions(true))
+	// a peer only supporting the regular ping protocol
+	b.RemoveStreamHandler(ping.KeepaliveID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, ping.Keepalive(ctx, a, b.ID(), 10*time.Millisecond), context.DeadlineExceeded)
+}
+
+func TestBackground(t *testing.T) {
+	_, b, psA, _ := pingtest.NewConnectedPair(t)
+	_, _, ok := psA.LatestRTT(b.ID())
+	require.False(t, ok)
+
+	psA.StartBackground(b.ID())
+	psA.StartBackground(b.ID()) // no-op
+	require.Eventually(t, func() bool {
+		_, _, ok := psA.LatestRTT(b.ID())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	rtt, at, _ := psA.LatestRTT(b.ID())
+	require.NotZero(t, rtt)
+	require.WithinDuration(t, time.Now(), at, 5*time.Second)
+	require.Equal(t, []peer.ID{b.ID()}, psA.ActivePeers())
+
+	psA.StopBackground(b.ID())
+	_, _, ok = psA.LatestRTT(b.ID())
+	require.False(t, ok)
+	require.Empty(t, psA.ActivePeers())
+	psA.StopBackground(b.ID()) // no-op
+}
+
+func TestBackgroundUnreachable(t *testing.T) {
+	h1, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	defer h2.Close()
+	ping.NewPingService(h2)
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.Resilient(10*time.Millisecond))
+	require.NoError(t, err)
+
+	// h2 can't be dialed, its addresses being unknown
+	ps1.StartBackground(h2.ID())
+	defer ps1.StopBackground(h2.ID())
+	time.Sleep(100 * time.Millisecond)
+	_, _, ok := ps1.LatestRTT(h2.ID())
+	require.False(t, ok)
+
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.PermanentAddrTTL)
+	require.Eventually(t, func() bool {
+		_, _, ok := ps1.LatestRTT(h2.ID())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBackgroundBackoff(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var attempts int32
+	psA, err := ping.NewPingServiceWithOptions(a, ping.OnResult(func(peer.ID, ping.Result) { atomic.AddInt32(&attempts, 1) }))
+	require.NoError(t, err)
+	psA.StartBackground(b.ID())
+	defer psA.StopBackground(b.ID())
+	require.Eventually(t, func() bool {
+		_, _, ok := psA.LatestRTT(b.ID())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the broken stream is reopened with a backoff, rather than failing
+	// every round right away
+	b.RemoveStreamHandler(ping.ID)
+	require.NoError(t, a.Network().ClosePeer(b.ID()))
+	before := atomic.LoadInt32(&attempts)
+	time.Sleep(500 * time.Millisecond)
+	require.LessOrEqual(t, atomic.LoadInt32(&attempts)-before, int32(5))
+}
+
+func TestPingCloseOnCancel(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		a, b, _, _ := pingtest.NewConnectedPair(t)
+		// an echo server reporting how its stream ended
+		ended := make(chan error, 1)
+		b.SetStreamHandler(ping.ID, func(s network.Stream) {
+			defer s.Close()
+			buf := make([]byte, ping.PingSize)
+			for {
+				if _, err := io.ReadFull(s, buf); err != nil {
+					ended <- err
+					return
+				}
+				if _, err := s.Write(buf); err != nil {
+					ended <- err
+					return
+				}
+			}
+		})
+
+		ps, err := ping.NewPingServiceWithOptions(a, ping.ResetOnCancel(reset))
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		results := ps.Ping(ctx, b.ID())
+		require.NoError(t, (<-results).Error)
+		cancel()
+		for range results {
+		}
+
+		select {
+		case err := <-ended:
+			if reset {
+				require.Error(t, err)
+				require.NotErrorIs(t, err, io.EOF)
+			} else {
+				require.ErrorIs(t, err, io.EOF)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream didn't end")
+		}
+	}
+}
+
+func TestPingDropRate(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	_, err := ping.NewPingServiceWithOptions(a, ping.DropRate(1.5))
+	require.Error(t, err)
+
+	ps, err := ping.NewPingServiceWithOptions(a, ping.DropRate(0.5), ping.Count(200))
+	require.NoError(t, err)
+	collect := func() (dropped []int) {
+		var i int
+		for res := range ps.Ping(context.Background(), b.ID()) {
+			if res.Error != nil {
+				require.ErrorIs(t, res.Error, ping.ErrRoundTimeout)
+				dropped = append(dropped, i)
+			}
+			i++
+		}
+		return dropped
+	}
+	dropped := collect()
+	require.Greater(t, len(dropped), 50)
+	require.Less(t, len(dropped), 150)
+	// the same rounds are dropped every time
+	require.Equal(t, dropped, collect())
+}
+
+func TestCollectAtLeast(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	ps, err := ping.NewPingServiceWithOptions(a, ping.DropRate(0.5))
+	require.NoError(t, err)
+	st, err := ps.CollectAtLeast(context.Background(), b.ID(), 10)
+	require.NoError(t, err)
+	require.Equal(t, 10, st.Received)
+	require.Greater(t, st.Sent, 10)
+	require.NotZero(t, st.Loss)
+
+	// every round is lost
+	ps, err = ping.NewPingServiceWithOptions(a, ping.DropRate(1))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	st, err = ps.CollectAtLeast(ctx, b.ID(), 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, st.Received)
+	require.Greater(t, st.Sent, 0)
+
+	_, err = ping.CollectAtLeast(context.Background(), a, b.ID(), 0)
+	require.Error(t, err)
+}
+
+func TestPingOnWire(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var mx sync.Mutex
+	var events []ping.WireEvent
+	ps, err := ping.NewPingServiceWithOptions(a, ping.Count(3), ping.OnWire(func(ev ping.WireEvent) {
+		mx.Lock()
+		defer mx.Unlock()
+		events = append(events, ev)
+	}))
+	require.NoError(t, err)
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, events, 6)
+	for i := 0; i < len(events); i += 2 {
+		write, read := events[i], events[i+1]
+		require.Equal(t, ping.WireWrite, write.Kind)
+		require.Equal(t, ping.WireRead, read.Kind)
+		require.Equal(t, uint64(i/2+1), write.Seq)
+		require.Equal(t, write.Seq, read.Seq)
+		require.Equal(t, b.ID(), write.Peer)
+		require.NotEmpty(t, write.Conn)
+		require.False(t, read.Time.Before(write.Time))
+	}
+}
+
+func TestPingContinueFunc(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	ps, err := ping.NewPingServiceWithOptions(a, ping.ContinueFunc(func(st ping.Statistics) bool {
+		return st.Received < 4
+	}))
+	require.NoError(t, err)
+	var n int
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+		n++
+	}
+	require.Equal(t, 4, n)
+
+	// stop once the loss exceeds a threshold
+	ps, err = ping.NewPingServiceWithOptions(a, ping.DropRate(1), ping.ContinueFunc(func(st ping.Statistics) bool {
+		return st.Sent < 3 || st.Loss < 0.5
+	}))
+	require.NoError(t, err)
+	n = 0
+	for range ps.Ping(context.Background(), b.ID()) {
+		n++
+	}
+	require.Equal(t, 3, n)
+}
+
+func TestPingBidirectional(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h1)
+	ping.NewPingService(h2)
+	aToB, bToA, err := ping.PingBidirectional(context.Background(), h1, h2, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, aToB.Received)
+	require.Equal(t, 3, bToA.Received)
+	require.NotZero(t, aToB.P50)
+	require.NotZero(t, bToA.P50)
+
+	// h3 doesn't answer pings
+	h3, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h3.Close() })
+	h1.Peerstore().AddAddrs(h3.ID(), h3.Addrs(), peerstore.PermanentAddrTTL)
+	h3.Peerstore().AddAddrs(h1.ID(), h1.Addrs(), peerstore.PermanentAddrTTL)
+	aToB, bToA, err = ping.PingBidirectional(context.Background(), h3, h1, 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "from "+h1.ID().String())
+	require.Zero(t, bToA.Received)
+	require.Equal(t, 3, aToB.Received)
+}
+
+func TestPingMaxAcceptableRTT(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	_, err := ping.NewPingServiceWithOptions(a, ping.MaxAcceptableRTT(0))
+	require.Error(t, err)
+
+	var mx sync.Mutex
+	var events []ping.StreamEvent
+	ps, err := ping.NewPingServiceWithOptions(a,
+		ping.Count(2),
+		ping.MaxAcceptableRTT(time.Nanosecond),
+		ping.Resilient(time.Millisecond),
+		ping.OnStreamEvent(func(evt ping.StreamEvent) {
+			mx.Lock()
+			defer mx.Unlock()
+			events = append(events, evt)
+		}),
+	)
+	require.NoError(t, err)
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.ErrorIs(t, res.Error, ping.ErrRTTExceeded)
+		require.NotZero(t, res.RTT)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	var kinds []ping.StreamEventKind
+	for _, evt := range events {
+		kinds = append(kinds, evt.Kind)
+		if evt.Kind == ping.StreamReset {
+			require.ErrorIs(t, evt.Err, ping.ErrRTTExceeded)
+		}
+	}
+	require.Equal(t, []ping.StreamEventKind{ping.StreamOpened, ping.StreamReset, ping.StreamReopened, ping.StreamReset}, kinds)
+}
+
+func TestAdditionalProtocolIDs(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	const legacyID = "/legacy/ping/1.0.0"
+	ps2, err := ping.NewPingServiceWithOptions(h2, ping.AdditionalProtocolIDs(legacyID), ping.ServeExtensions(true))
+	require.NoError(t, err)
+	require.Contains(t, h2.Mux().Protocols(), legacyID)
+
+	// a client only speaking the legacy ID
+	h2.RemoveStreamHandler(ping.ID)
+	ps1, err := ping.NewPingServiceWithOptions(h1, ping.AdditionalProtocolIDs(legacyID))
+	require.NoError(t, err)
+	res := ps1.PingOnce(context.Background(), h2.ID())
+	require.NoError(t, res.Error)
+	_, err = ps1.Diagnose(context.Background(), h2.ID(), 100*time.Millisecond)
+	require.NoError(t, err)
+
+	require.NoError(t, ps2.Close())
+	for _, id := range []protocol.ID{legacyID, ping.TimestampID, ping.TimestampExtID, ping.SizedID, ping.KeepaliveID} {
+		require.NotContains(t, h2.Mux().Protocols(), string(id))
+	}
+	// h1's handlers are unaffected
+	require.Contains(t, h1.Mux().Protocols(), legacyID)
+}
+
+func TestServeExtensions(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	extensions := []protocol.ID{ping.TimestampID, ping.TimestampExtID, ping.SizedID, ping.KeepaliveID}
+	require.Contains(t, b.Mux().Protocols(), string(ping.ID))
+	for _, id := range extensions {
+		require.NotContains(t, b.Mux().Protocols(), string(id))
+	}
+
+	// sized rounds need the extension
+	ps, err := ping.NewPingServiceWithOptions(a, ping.PayloadSize(100))
+	require.NoError(t, err)
+	require.Error(t, ps.PingOnce(context.Background(), b.ID()).Error)
+	// keepalives fall back to ID
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, ping.Keepalive(ctx, a, b.ID(), 10*time.Millisecond), context.DeadlineExceeded)
+
+	_, err = ping.NewPingServiceWithOptions(b, ping.ServeExtensions(true))
+	require.NoError(t, err)
+	for _, id := range extensions {
+		require.Contains(t, b.Mux().Protocols(), string(id))
+	}
+	require.NoError(t, ps.PingOnce(context.Background(), b.ID()).Error)
+}
+
+func TestCloseAlertEmitter(t *testing.T) {
+	h, _ := connectedHosts(t)
+	hasEmitter := func() bool {
+		for _, typ := range h.EventBus().GetAllEventTypes() {
+			if typ == reflect.TypeOf(ping.EvtPingAlert{}) {
+				return true
+			}
+		}
+		return false
+	}
+	ps, err := ping.NewPingServiceWithOptions(h, ping.AlertThresholds(time.Second, 2*time.Second, 0))
+	require.NoError(t, err)
+	require.True(t, hasEmitter())
+	require.NoError(t, ps.Close())
+	require.False(t, hasEmitter())
+	require.NoError(t, ps.Close())
+
+	// nor does a service failing to be configured leak it
+	_, err = ping.NewPingServiceWithOptions(h, ping.AlertThresholds(time.Second, 2*time.Second, 0), ping.Count(0))
+	require.Error(t, err)
+	require.False(t, hasEmitter())
+}
+
+func TestPingStreamRotateInterval(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	var mx sync.Mutex
+	var kinds []ping.StreamEventKind
+	ps, err := ping.NewPingServiceWithOptions(a,
+		ping.Count(2),
+		ping.StreamRotateInterval(time.Nanosecond),
+		ping.OnStreamEvent(func(evt ping.StreamEvent) {
+			mx.Lock()
+			defer mx.Unlock()
+			kinds = append(kinds, evt.Kind)
+		}),
+	)
+	require.NoError(t, err)
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	mx.Lock()
+	require.Equal(t, []ping.StreamEventKind{ping.StreamOpened, ping.StreamRotated, ping.StreamOpened, ping.StreamRotated}, kinds)
+	mx.Unlock()
+
+	// streams are reused within the interval
+	kinds = nil
+	ps, err = ping.NewPingServiceWithOptions(a,
+		ping.Count(3),
+		ping.StreamRotateInterval(time.Hour),
+		ping.OnStreamEvent(func(evt ping.StreamEvent) {
+			mx.Lock()
+			defer mx.Unlock()
+			kinds = append(kinds, evt.Kind)
+		}),
+	)
+	require.NoError(t, err)
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	require.Equal(t, []ping.StreamEventKind{ping.StreamOpened}, kinds)
+}
+
+func TestReopenCount(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	// every round fails, and the stream is reopened
+	ps, err := ping.NewPingServiceWithOptions(a, ping.MaxAcceptableRTT(time.Nanosecond), ping.Resilient(time.Millisecond))
+	require.NoError(t, err)
+	require.Zero(t, ps.ReopenCount(b.ID()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := ps.Ping(ctx, b.ID())
+	for i := 0; i < 3; i++ {
+		require.Error(t, (<-results).Error)
+	}
+	require.GreaterOrEqual(t, ps.ReopenCount(b.ID()), 2)
+
+	cancel()
+	for range results {
+	}
+	require.Eventually(t, func() bool { return ps.ReopenCount(b.ID()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPingDialTimeout(t *testing.T) {
+	// a peer accepting connections, but never completing the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	h, err := bhost.NewHost(swarmt.GenSwarm(t), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	slow := test.RandPeerIDFatal(t)
+	h.Peerstore().AddAddr(slow, ma.StringCast("/ip4/127.0.0.1/tcp/"+strconv.Itoa(l.Addr().(*net.TCPAddr).Port)), peerstore.PermanentAddrTTL)
+
+	_, err = ping.NewPingServiceWithOptions(h, ping.DialTimeout(0))
+	require.Error(t, err)
+	ps, err := ping.NewPingServiceWithOptions(h, ping.DialTimeout(200*time.Millisecond), ping.Timeout(time.Second))
+	require.NoError(t, err)
+	start := time.Now()
+	res := ps.PingOnce(context.Background(), slow)
+	require.Error(t, res.Error)
+	require.Contains(t, res.Error.Error(), "dial timed out")
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// Diagnose dials like Ping, retries included
+	ps, err = ping.NewPingServiceWithOptions(h, ping.DialTimeout(200*time.Millisecond), ping.DialRetries(1, 10*time.Millisecond))
+	require.NoError(t, err)
+	start = time.Now()
+	_, err = ps.Diagnose(context.Background(), slow, 10*time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dial timed out")
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// and so does Keepalive
+	start = time.Now()
+	err = ps.Keepalive(context.Background(), slow, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dial timed out")
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// a generous dial timeout doesn't slow down rounds
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h2)
+	ps, err = ping.NewPingServiceWithOptions(h1, ping.DialTimeout(time.Minute), ping.Timeout(time.Second))
+	require.NoError(t, err)
+	res = ps.PingOnce(context.Background(), h2.ID())
+	require.NoError(t, res.Error)
+	require.Less(t, res.RTT, time.Second)
+}
+
+func TestStatus(t *testing.T) {
+	h1, h2 := connectedHosts(t)
+	ping.NewPingService(h2)
+	ps := ping.NewPingService(h1)
+
+	status := ps.Status(h2.ID())
+	require.Equal(t, h2.ID(), status.Peer)
+	require.Equal(t, network.Connected, status.Connectedness)
+	require.NotEmpty(t, status.Transports)
+	require.Zero(t, status.Sessions)
+	require.Zero(t, status.SmoothedRTT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := ps.Ping(ctx, h2.ID())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, (<-results).Error)
+	}
+	status = ps.Status(h2.ID())
+	require.Equal(t, 1, status.Sessions)
+	require.NotZero(t, status.SmoothedRTT)
+	require.Zero(t, status.Loss)
+	require.NoError(t, status.LastError)
+	require.False(t, status.LastSample.IsZero())
+	cancel()
+	for range results {
+	}
+
+	status = ps.Status(test.RandPeerIDFatal(t))
+	require.Equal(t, network.NotConnected, status.Connectedness)
+	require.Empty(t, status.Transports)
+}
+
+func TestPingOverhead(t *testing.T) {
+	a, b, psA, _ := pingtest.NewConnectedPair(t)
+	require.NoError(t, psA.PingOnce(context.Background(), b.ID()).Error)
+	require.Zero(t, psA.Overhead())
+
+	ps, err := ping.NewPingServiceWithOptions(a, ping.Count(3), ping.MeasureOverhead(true))
+	require.NoError(t, err)
+	for res := range ps.Ping(context.Background(), b.ID()) {
+		require.NoError(t, res.Error)
+	}
+	overhead := ps.Overhead()
+	require.Equal(t, 3, overhead.Rounds)
+	require.Greater(t, overhead.Processing, time.Duration(0))
+	require.NotZero(t, overhead.Allocs)
+}
+
+func TestPingHandlerPool(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t, ping.HandlerPool(1, 0))
+	roundTrip := func(s network.Stream) error {
+		buf := make([]byte, ping.PingSize)
+		if _, err := s.Write(buf); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(s, buf)
+		return err
+	}
+
+	// the only worker is busy serving s1
+	s1, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+	require.NoError(t, err)
+	require.NoError(t, roundTrip(s1))
+	s2, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+	require.NoError(t, err)
+	require.Error(t, roundTrip(s2))
+	s2.Reset()
+
+	// the worker is free again once s1 ended
+	s1.Reset()
+	require.Eventually(t, func() bool {
+		s, err := a.NewStream(context.Background(), b.ID(), ping.ID)
+		if err != nil {
+			return false
+		}
+		defer s.Reset()
+		return roundTrip(s) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPingHandlerPoolFiltered(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	var hosts [3]host.Host
+	for i := range hosts {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+		hosts[i] = h
+	}
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	allowed, filtered, b := hosts[0], hosts[1], hosts[2]
+	_, err := ping.NewPingServiceWithOptions(b, ping.HandlerPool(1, 1), ping.InboundFilter(func(p peer.ID) bool { return p == allowed.ID() }))
+	require.NoError(t, err)
+
+	buf := make([]byte, ping.PingSize)
+	// the only worker is busy serving s1
+	s1, err := allowed.NewStream(context.Background(), b.ID(), ping.ID)
+	require.NoError(t, err)
+	defer s1.Reset()
+	_, err = s1.Write(buf)
+	require.NoError(t, err)
+	_, err = io.ReadFull(s1, buf)
+	require.NoError(t, err)
+
+	// the filtered peer is rejected without taking the queue slot
+	for i := 0; i < 3; i++ {
+		s, err := filtered.NewStream(context.Background(), b.ID(), ping.ID)
+		require.NoError(t, err)
+		var queued int32
+		timer := time.AfterFunc(5*time.Second, func() {
+			atomic.StoreInt32(&queued, 1)
+			s.Reset()
+		})
+		_, err = s.Write(buf)
+		require.NoError(t, err)
+		_, err = io.ReadFull(s, buf)
+		timer.Stop()
+		require.Error(t, err)
+		require.Zero(t, atomic.LoadInt32(&queued), "filtered stream was queued")
+		s.Reset()
+	}
+
+	// so the allowed peer's next stream is queued, and served once s1 ended
+	s2, err := allowed.NewStream(context.Background(), b.ID(), ping.ID)
+	require.NoError(t, err)
+	defer s2.Reset()
+	_, err = s2.Write(buf)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	s1.Reset()
+	timer := time.AfterFunc(5*time.Second, func() { s2.Reset() })
+	defer timer.Stop()
+	_, err = io.ReadFull(s2, buf)
+	require.NoError(t, err)
+}
+
+func TestUnreachableContext(t *testing.T) {
+	a, b, _, _ := pingtest.NewConnectedPair(t)
+	ps, err := ping.NewPingServiceWithOptions(a, ping.Resilient(10*time.Millisecond))
+	require.NoError(t, err)
+	ctx := ps.UnreachableContext(context.Background(), b.ID(), 2)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, ctx.Err())
+
+	// b stops answering pings
+	b.RemoveStreamHandler(ping.ID)
+	require.NoError(t, a.Network().ClosePeer(b.ID()))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled")
+	}
+	require.Eventually(t, func() bool {
+		return len(ps.ActivePeers()) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// canceling the parent ends the session
+	parent, cancel := context.WithCancel(context.Background())
+	_, b2, ps2, _ := pingtest.NewConnectedPair(t)
+	ctx = ps2.UnreachableContext(parent, b2.ID(), 3)
+	require.Eventually(t, func() bool {
+		return len(ps2.ActivePeers()) == 1
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-ctx.Done()
+	require.Eventually(t, func() bool {
+		return len(ps2.ActivePeers()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
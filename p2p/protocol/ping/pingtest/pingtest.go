@@ -0,0 +1,44 @@
+// Package pingtest provides helpers for tests of code that depends on the ping service.
+package pingtest
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// NewConnectedPair creates two hosts connected over an in-memory network, each
+// running a ping service. Everything is closed when the test finishes.
+func NewConnectedPair(t testing.TB, opts ...ping.Option) (a, b host.Host, psA, psB *ping.PingService) {
+	t.Helper()
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+
+	a, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	psA, err = ping.NewPingServiceWithOptions(a, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psB, err = ping.NewPingServiceWithOptions(b, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, psA, psB
+}
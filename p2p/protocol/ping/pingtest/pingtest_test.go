@@ -0,0 +1,18 @@
+package pingtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnectedPair(t *testing.T) {
+	a, b, psA, psB := NewConnectedPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, (<-psA.Ping(ctx, b.ID())).Error)
+	require.NoError(t, (<-psB.Ping(ctx, a.ID())).Error)
+}
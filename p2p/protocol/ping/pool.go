@@ -0,0 +1,82 @@
+package ping
+
+import (
+	"sync"
+)
+
+// handlerPool serves inbound ping streams on at most a fixed number of
+// goroutines, see HandlerPool. Workers are started on demand, and exit once
+// there are no queued streams left.
+type handlerPool struct {
+	workers, queueSize int
+	// reports the number of queued streams whenever it changes
+	depth func(int)
+
+	mx     sync.Mutex
+	active int
+	queue  []func()
+	closed bool
+}
+
+func newHandlerPool(workers, queue int, depth func(int)) *handlerPool {
+	return &handlerPool{
+		workers:   workers,
+		queueSize: queue,
+		depth:     depth,
+	}
+}
+
+// submit has serve run by a worker, right away if one is available, or once
+// one becomes available otherwise. It returns false if the queue is full or
+// the pool was closed.
+func (hp *handlerPool) submit(serve func()) bool {
+	hp.mx.Lock()
+	defer hp.mx.Unlock()
+
+	switch {
+	case hp.closed:
+		return false
+	case hp.active < hp.workers:
+		hp.active++
+		go hp.work(serve)
+		return true
+	case len(hp.queue) < hp.queueSize:
+		hp.queue = append(hp.queue, serve)
+		hp.depth(len(hp.queue))
+		return true
+	default:
+		return false
+	}
+}
+
+// work runs serve, then the queued streams until there are none left.
+func (hp *handlerPool) work(serve func()) {
+	for serve != nil {
+		serve()
+		serve = hp.next()
+	}
+}
+
+// next dequeues the next stream to serve. If there's none, the worker is
+// released and it returns nil.
+func (hp *handlerPool) next() func() {
+	hp.mx.Lock()
+	defer hp.mx.Unlock()
+
+	if len(hp.queue) == 0 {
+		hp.active--
+		return nil
+	}
+	serve := hp.queue[0]
+	hp.queue[0] = nil
+	hp.queue = hp.queue[1:]
+	hp.depth(len(hp.queue))
+	return serve
+}
+
+// close makes the pool reject new streams. Queued streams are still served.
+func (hp *handlerPool) close() {
+	hp.mx.Lock()
+	defer hp.mx.Unlock()
+	hp.closed = true
+}
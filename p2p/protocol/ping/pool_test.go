@@ -0,0 +1,39 @@
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerPool(t *testing.T) {
+	var depths []int
+	hp := newHandlerPool(1, 1, func(n int) { depths = append(depths, n) })
+	release := make(chan struct{})
+	served := make(chan int, 3)
+	serve := func(i int) func() {
+		return func() {
+			<-release
+			served <- i
+		}
+	}
+
+	require.True(t, hp.submit(serve(1)))
+	require.True(t, hp.submit(serve(2)), "queued")
+	require.False(t, hp.submit(serve(3)), "queue full")
+
+	release <- struct{}{}
+	require.Equal(t, 1, <-served)
+	release <- struct{}{}
+	require.Equal(t, 2, <-served)
+	require.Eventually(t, func() bool {
+		hp.mx.Lock()
+		defer hp.mx.Unlock()
+		return hp.active == 0
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []int{1, 0}, depths)
+
+	hp.close()
+	require.False(t, hp.submit(serve(4)))
+}
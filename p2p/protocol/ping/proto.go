@@ -0,0 +1,51 @@
+package ping
+
+import (
+	"context"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/ping/pb"
+
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+// EncodeResult returns the protobuf form of res, the result with the given
+// sequence number of a ping session to p.
+func EncodeResult(p peer.ID, seq uint64, res Result) *pb.Result {
+	msg := &pb.Result{
+		Peer: []byte(p),
+		Seq:  &seq,
+	}
+	if !res.Time.IsZero() {
+		t := res.Time.UnixNano()
+		msg.Time = &t
+	}
+	if res.Error != nil {
+		e := res.Error.Error()
+		msg.Error = &e
+	} else {
+		rtt := int64(res.RTT)
+		msg.Rtt = &rtt
+	}
+	return msg
+}
+
+// StreamProto pings p until the context is done, and writes every result to w
+// as a varint length-delimited pb.Result message, as defined in pb/ping.proto.
+// It returns the error that stopped the stream.
+func StreamProto(ctx context.Context, h host.Host, p peer.ID, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wr := protoio.NewDelimitedWriter(w)
+	var seq uint64
+	for res := range Ping(ctx, h, p) {
+		if err := wr.WriteMsg(EncodeResult(p, seq, res)); err != nil {
+			return err
+		}
+		seq++
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,87 @@
+package ping
+
+import (
+	"io"
+	"time"
+)
+
+// RawStream is the minimal stream the ping protocol runs over, such as a
+// net.Conn. It lets the protocol be exercised without a host, e.g. over an
+// in-memory net.Pipe.
+type RawStream interface {
+	io.Reader
+	io.Writer
+	SetDeadline(time.Time) error
+}
+
+// PingRaw performs a single ping round over s, configured with opts, and
+// returns its RTT. It needs no host, so options that depend on one, such as
+// AlertThresholds, fail. See PingService.PingRaw.
+func PingRaw(s RawStream, opts ...Option) (time.Duration, error) {
+	ps, err := newRawPingService(opts)
+	if err != nil {
+		return 0, err
+	}
+	return ps.PingRaw(s)
+}
+
+// ServeRaw answers ping rounds from s, configured with opts, until a round
+// fails. It needs no host, like PingRaw. See PingService.ServeRaw.
+func ServeRaw(s RawStream, opts ...Option) error {
+	ps, err := newRawPingService(opts)
+	if err != nil {
+		return err
+	}
+	return ps.ServeRaw(s)
+}
+
+// newRawPingService returns a service without a host, configured with opts.
+func newRawPingService(opts []Option) (*PingService, error) {
+	ps := newPingService(nil)
+	for _, o := range opts {
+		if err := o(ps); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// PingRaw performs a single ping round over s with a PingSize payload, and
+// returns its RTT. The round fails once the Timeout of the service elapsed,
+// enforced through the deadline of s, which is cleared afterwards. The
+// verification options apply as configured; the stream, session and
+// peerstore related ones don't.
+func (ps *PingService) PingRaw(s RawStream) (time.Duration, error) {
+	ra, err := newRand()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.SetDeadline(time.Now().Add(ps.timeout)); err != nil {
+		return 0, err
+	}
+	defer s.SetDeadline(time.Time{})
+
+	buf := ps.getBuf(PingSize)
+	defer ps.putBuf(buf)
+	rbuf := ps.getBuf(PingSize)
+	defer ps.putBuf(rbuf)
+	res, err := ps.pingPayload(s, ra, buf, rbuf)
+	if err != nil {
+		return 0, err
+	}
+	return res.RTT, nil
+}
+
+// ServeRaw answers ping rounds from s, as the PingHandler does for streams,
+// until a round fails, and returns the error. If the peer goes idle for the
+// Timeout of the service, unless disabled with NoIdleTimeout, the round in
+// progress is failed by moving the deadline of s to the past.
+func (ps *PingService) ServeRaw(s RawStream) error {
+	buf := ps.getBuf(PingSize)
+	defer ps.putBuf(buf)
+	return ps.serveRounds(buf, func(buf []byte) error {
+		return ps.echo(s, buf, nil)
+	}, func() {
+		s.SetDeadline(time.Now())
+	})
+}
@@ -0,0 +1,63 @@
+package ping_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPingRaw(t *testing.T) {
+	client, server := net.Pipe()
+	served := make(chan error, 1)
+	go func() { served <- ping.ServeRaw(server) }()
+
+	for i := 0; i < 3; i++ {
+		rtt, err := ping.PingRaw(client)
+		require.NoError(t, err)
+		require.NotZero(t, rtt)
+	}
+	client.Close()
+	require.Error(t, <-served)
+}
+
+func TestPingRawCorrupted(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, ping.PingSize)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			return
+		}
+		buf[0]++
+		server.Write(buf)
+	}()
+
+	_, err := ping.PingRaw(client)
+	require.Error(t, err)
+}
+
+func TestPingRawTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	_, err := ping.PingRaw(client, ping.Timeout(50*time.Millisecond))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the server gives up on idle peers too
+	idle, server2 := net.Pipe()
+	defer idle.Close()
+	require.ErrorIs(t, ping.ServeRaw(server2, ping.Timeout(50*time.Millisecond)), os.ErrDeadlineExceeded)
+
+	// options requiring a host are rejected
+	_, err = ping.PingRaw(client, ping.AlertThresholds(time.Second, 2*time.Second, 0))
+	require.Error(t, err)
+}
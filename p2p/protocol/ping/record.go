@@ -0,0 +1,113 @@
+package ping
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// traceHeader is the first line of every recorded trace.
+//
+// A trace is a text file with one line per result, in the order they were
+// produced. Each line has two or three tab separated fields: the start time
+// of the attempt in nanoseconds since the unix epoch, the RTT in nanoseconds,
+// and, for failed attempts, the error message as a Go quoted string. Lines
+// starting with '#' are comments.
+const traceHeader = "# libp2p ping trace v1"
+
+// RecordResults writes every result received on results to w, in the trace
+// format understood by ReplayResults, and forwards it on the returned channel.
+// The returned channel is closed once results is closed.
+//
+// If writing to w fails, recording stops but results are still forwarded.
+func RecordResults(w io.Writer, results <-chan Result) <-chan Result {
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+
+		_, err := fmt.Fprintln(w, traceHeader)
+		for res := range results {
+			if err == nil {
+				if err = writeTraceLine(w, res); err != nil {
+					log.Debugf("failed to record ping result: %s", err)
+				}
+			}
+			out <- res
+		}
+	}()
+	return out
+}
+
+func writeTraceLine(w io.Writer, res Result) error {
+	if res.Error != nil {
+		_, err := fmt.Fprintf(w, "%d\t%d\t%s\n", res.Time.UnixNano(), res.RTT, strconv.Quote(res.Error.Error()))
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d\t%d\n", res.Time.UnixNano(), res.RTT)
+	return err
+}
+
+// ReplayResults reads a trace written by RecordResults, and replays its
+// results on the returned channel, separated by the same intervals as when
+// they were recorded. Errors are replayed with their original message only.
+//
+// The whole trace is parsed before replaying starts, so malformed input is
+// reported right away. The returned channel must be drained.
+func ReplayResults(r io.Reader) (<-chan Result, error) {
+	var results []Result
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		res, err := parseTraceLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		results = append(results, res)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		for i, res := range results {
+			if i > 0 {
+				time.Sleep(res.Time.Sub(results[i-1].Time))
+			}
+			out <- res
+		}
+	}()
+	return out, nil
+}
+
+func parseTraceLine(text string) (Result, error) {
+	fields := strings.SplitN(text, "\t", 3)
+	if len(fields) < 2 {
+		return Result{}, errors.New("malformed trace line")
+	}
+	t, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid time: %w", err)
+	}
+	rtt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid RTT: %w", err)
+	}
+	res := Result{Time: time.Unix(0, t), RTT: time.Duration(rtt)}
+	if len(fields) == 3 {
+		msg, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return Result{}, fmt.Errorf("invalid error: %w", err)
+		}
+		res.Error = errors.New(msg)
+	}
+	return res, nil
+}
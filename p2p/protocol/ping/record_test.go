@@ -0,0 +1,56 @@
+package ping_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	recorded := []ping.Result{
+		{Time: start, RTT: 3 * time.Millisecond},
+		{Time: start.Add(50 * time.Millisecond), Error: errors.New("stream reset\twith \"tabs\"")},
+		{Time: start.Add(100 * time.Millisecond), RTT: 5 * time.Millisecond},
+	}
+	in := make(chan ping.Result, len(recorded))
+	for _, res := range recorded {
+		in <- res
+	}
+	close(in)
+
+	var trace bytes.Buffer
+	var n int
+	for res := range ping.RecordResults(&trace, in) {
+		require.Equal(t, recorded[n], res)
+		n++
+	}
+	require.Equal(t, len(recorded), n)
+
+	replayStart := time.Now()
+	replayed, err := ping.ReplayResults(&trace)
+	require.NoError(t, err)
+	n = 0
+	for res := range replayed {
+		exp := recorded[n]
+		require.True(t, exp.Time.Equal(res.Time))
+		require.Equal(t, exp.RTT, res.RTT)
+		if exp.Error != nil {
+			require.EqualError(t, res.Error, exp.Error.Error())
+		} else {
+			require.NoError(t, res.Error)
+		}
+		n++
+	}
+	require.Equal(t, len(recorded), n)
+	require.GreaterOrEqual(t, time.Since(replayStart), 100*time.Millisecond)
+
+	_, err = ping.ReplayResults(strings.NewReader("# libp2p ping trace v1\n123\tabc\n"))
+	require.Error(t, err)
+}
@@ -0,0 +1,368 @@
+package ping
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// number of recent RTTs used to compute the median when detecting outliers
+	medianWindow = 32
+	// minimum number of samples before outliers are detected
+	minOutlierSamples = 5
+	// maximum number of outliers kept per peer
+	maxOutliers = 16
+	// smoothing factor of the smoothed RTT, same as the peerstore's
+	rttSmoothing = 0.1
+)
+
+// ErrNoSession is returned by LastError when there's no active ping session
+// to the peer.
+var ErrNoSession = errors.New("no active ping session to peer")
+
+// OutlierSample is a ping round whose RTT exceeded the configured multiple of
+// the median RTT, together with the context it happened in.
+type OutlierSample struct {
+	Time      time.Time
+	RTT       time.Duration
+	Median    time.Duration
+	Conn      string // the connection ID
+	Direction network.Direction
+	Transport string
+	Local     ma.Multiaddr
+	Remote    ma.Multiaddr
+}
+
+// peerState is the state the service keeps about a peer while there are
+// active ping sessions to it.
+type peerState struct {
+	// bytes written and read by the sessions, accessed atomically. Kept
+	// first for 64-bit alignment.
+	sent, recv int64
+
+	sessions int
+
+	recent   []time.Duration // recent RTTs, oldest first
+	outliers []OutlierSample // oldest first
+
+	smoothed time.Duration // EWMA of the RTT
+	alert    AlertLevel
+
+	// when the last failed round was delivered, zero while the peer is
+	// reachable
+	lastError time.Time
+	// when the last successful round was started
+	lastSample time.Time
+
+	// attempts and failed attempts, and the last attempt's result
+	attempts, failures int
+	last               Result
+
+	// consecutive successful (positive) or failed (negative) attempts, and
+	// the health last reported to the HealthSink
+	streak int
+	health health
+
+	// number of streams reopened after a failure
+	reopens int
+}
+
+// default numbers of consecutive successful and failed attempts for a peer to
+// be reported healthy and unhealthy to the HealthSink
+const (
+	defaultHealthyAfter   = 1
+	defaultUnhealthyAfter = 3
+)
+
+// health is the health of a peer as reported to the HealthSink.
+type health int
+
+const (
+	healthUnknown health = iota
+	healthy
+	unhealthy
+)
+
+// addSession registers a new ping session to p.
+func (ps *PingService) addSession(p peer.ID) *peerState {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	if ps.peers == nil {
+		ps.peers = make(map[peer.ID]*peerState)
+	}
+	st, ok := ps.peers[p]
+	if !ok {
+		st = &peerState{}
+		ps.peers[p] = st
+	}
+	st.sessions++
+	return st
+}
+
+// removeSession unregisters a ping session to p. The peer's state is removed
+// once its last session ends.
+func (ps *PingService) removeSession(p peer.ID) {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	st, ok := ps.peers[p]
+	if !ok {
+		return
+	}
+	st.sessions--
+	if st.sessions == 0 {
+		delete(ps.peers, p)
+	}
+}
+
+// plausible reports whether rtt is within the factor set with
+// RecordLatencyFilter of the smoothed RTT of the peer, if any.
+func (ps *PingService) plausible(st *peerState, rtt time.Duration) bool {
+	if ps.recordFilter == 0 {
+		return true
+	}
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+	return st.smoothed == 0 || float64(rtt) <= ps.recordFilter*float64(st.smoothed)
+}
+
+// observe records a successful round over conn, started at the given time. It
+// returns the alert to emit if the round changed the peer's alert level.
+func (ps *PingService) observe(st *peerState, p peer.ID, rtt time.Duration, at time.Time, conn network.Conn) *EvtPingAlert {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	if ps.outlierFactor > 0 && len(st.recent) >= minOutlierSamples {
+		median := medianOf(st.recent)
+		if float64(rtt) > ps.outlierFactor*float64(median) {
+			if len(st.outliers) == maxOutliers {
+				st.outliers = append(st.outliers[:0], st.outliers[1:]...)
+			}
+			st.outliers = append(st.outliers, OutlierSample{
+				Time:      at,
+				RTT:       rtt,
+				Median:    median,
+				Conn:      conn.ID(),
+				Direction: conn.Stat().Direction,
+				Transport: transportName(conn.RemoteMultiaddr()),
+				Local:     conn.LocalMultiaddr(),
+				Remote:    conn.RemoteMultiaddr(),
+			})
+		}
+	}
+
+	if len(st.recent) == medianWindow {
+		st.recent = append(st.recent[:0], st.recent[1:]...)
+	}
+	st.recent = append(st.recent, rtt)
+
+	switch {
+	case st.smoothed == 0:
+		st.smoothed = rtt
+	case ps.halfLife > 0:
+		// the estimate decays with the time elapsed since the last sample
+		elapsed := at.Sub(st.lastSample)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		w := math.Exp2(-float64(elapsed) / float64(ps.halfLife))
+		st.smoothed = time.Duration(w*float64(st.smoothed) + (1-w)*float64(rtt))
+	default:
+		st.smoothed = time.Duration((1-rttSmoothing)*float64(st.smoothed) + rttSmoothing*float64(rtt))
+	}
+	st.lastSample = at
+
+	if ps.alerts != nil {
+		if level := ps.alerts.level(st.alert, st.smoothed); level != st.alert {
+			st.alert = level
+			return &EvtPingAlert{Peer: p, Level: level, SmoothedRTT: st.smoothed}
+		}
+	}
+	return nil
+}
+
+// track records the outcome of an attempt to p, and reports health
+// transitions to the HealthSink.
+func (ps *PingService) track(st *peerState, p peer.ID, res Result) {
+	ps.peersMx.Lock()
+	st.attempts++
+	if res.Error != nil {
+		st.failures++
+	}
+	st.last = res
+
+	changed := false
+	if ps.healthSink != nil {
+		if res.Error == nil {
+			if st.streak < 0 {
+				st.streak = 0
+			}
+			st.streak++
+			if st.health != healthy && st.streak >= ps.healthyAfter {
+				st.health = healthy
+				changed = true
+			}
+		} else {
+			if st.streak > 0 {
+				st.streak = 0
+			}
+			st.streak--
+			if st.health != unhealthy && -st.streak >= ps.unhealthyAfter {
+				st.health = unhealthy
+				changed = true
+			}
+		}
+	}
+	h := st.health
+	ps.peersMx.Unlock()
+
+	if changed {
+		ps.healthSink(p, h == healthy)
+	}
+}
+
+// suppressError reports whether the result of a round should be suppressed,
+// because a failed round was already delivered for the peer within the window
+// set with SuppressRepeatedErrors. A successful round resets the peer's state.
+func (ps *PingService) suppressError(st *peerState, failed bool, now time.Time) bool {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	if !failed {
+		st.lastError = time.Time{}
+		return false
+	}
+	if !st.lastError.IsZero() && now.Sub(st.lastError) < ps.errorDedup {
+		return true
+	}
+	st.lastError = now
+	return false
+}
+
+// Outliers returns the most recent outlier samples recorded for p, oldest
+// first. Outliers are only recorded with the OutlierFactor option, and only
+// kept while there's an active ping session to p.
+func (ps *PingService) Outliers(p peer.ID) []OutlierSample {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	st, ok := ps.peers[p]
+	if !ok {
+		return nil
+	}
+	return append([]OutlierSample(nil), st.outliers...)
+}
+
+// LastError returns the error of the last attempt of the active ping sessions
+// to p, or nil if it succeeded or no attempt completed yet. It returns
+// ErrNoSession if there's no active session to p.
+func (ps *PingService) LastError(p peer.ID) error {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	st, ok := ps.peers[p]
+	if !ok {
+		return ErrNoSession
+	}
+	return st.last.Error
+}
+
+// ReopenCount returns the number of times the active ping sessions to p
+// reopened their stream after a failure, in resilient mode. A high count
+// hints at an unstable connection even if the RTTs look fine. It is zero if
+// there's no active session to p.
+func (ps *PingService) ReopenCount(p peer.ID) int {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	st, ok := ps.peers[p]
+	if !ok {
+		return 0
+	}
+	return st.reopens
+}
+
+// countReopen records that a session reopened its stream after a failure.
+func (ps *PingService) countReopen(st *peerState) {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+	st.reopens++
+}
+
+// SessionBytes returns the number of ping payload bytes sent to and received
+// from p by the active ping sessions to p, across the streams they used. The
+// count is kept from the start of the first active session, and is zero if
+// there's no active session to p.
+func (ps *PingService) SessionBytes(p peer.ID) (sent, recv int64) {
+	ps.peersMx.Lock()
+	st, ok := ps.peers[p]
+	ps.peersMx.Unlock()
+	if !ok {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&st.sent), atomic.LoadInt64(&st.recv)
+}
+
+// countingStream counts the bytes written to and read from a ping stream into
+// the peer's state.
+type countingStream struct {
+	network.Stream
+	st *peerState
+}
+
+func (s *countingStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	atomic.AddInt64(&s.st.recv, int64(n))
+	return n, err
+}
+
+func (s *countingStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	atomic.AddInt64(&s.st.sent, int64(n))
+	return n, err
+}
+
+// ActivePeers returns the peers there are active outbound ping sessions to,
+// in no particular order.
+func (ps *PingService) ActivePeers() []peer.ID {
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+
+	peers := make([]peer.ID, 0, len(ps.peers))
+	for p := range ps.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func medianOf(rtts []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// transportName returns the name of the transport used by a connection to
+// addr, e.g. "tcp", "quic" or "ws". Relayed connections are labeled "relay".
+func transportName(addr ma.Multiaddr) string {
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return "relay"
+	}
+	var name string
+	for _, p := range addr.Protocols() {
+		switch p.Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_IP6ZONE, ma.P_DNS, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR, ma.P_P2P, ma.P_CERTHASH:
+		default:
+			name = p.Name
+		}
+	}
+	return name
+}
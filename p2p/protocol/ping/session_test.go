@@ -0,0 +1,139 @@
+package ping
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportName(t *testing.T) {
+	for addr, name := range map[string]string{
+		"/ip4/1.2.3.4/tcp/1234":         "tcp",
+		"/ip6/::1/udp/1234/quic":        "quic",
+		"/dns4/example.com/tcp/443/wss": "wss",
+		"/ip4/1.2.3.4/tcp/1234/p2p/QmTkQUiSMqQxsGfD3NjzJSeQ6o2mnWYNBUX8E4vtRQuqvR/p2p-circuit": "relay",
+	} {
+		require.Equal(t, name, transportName(ma.StringCast(addr)), addr)
+	}
+}
+
+func TestOutliers(t *testing.T) {
+	ps := newPingService(nil)
+	ps.outlierFactor = 3
+	p := peer.ID("peer")
+	st := ps.addSession(p)
+
+	conn := &mockConn{local: ma.StringCast("/ip4/127.0.0.1/tcp/1"), remote: ma.StringCast("/ip4/127.0.0.1/tcp/2")}
+	for i := 0; i < minOutlierSamples; i++ {
+		ps.observe(st, p, 10*time.Millisecond, time.Now(), conn)
+	}
+	require.Empty(t, ps.Outliers(p))
+	ps.observe(st, p, 25*time.Millisecond, time.Now(), conn)
+	require.Empty(t, ps.Outliers(p))
+	ps.observe(st, p, 50*time.Millisecond, time.Now(), conn)
+	outliers := ps.Outliers(p)
+	require.Len(t, outliers, 1)
+	require.Equal(t, 50*time.Millisecond, outliers[0].RTT)
+	require.Equal(t, 10*time.Millisecond, outliers[0].Median)
+	require.Equal(t, "tcp", outliers[0].Transport)
+
+	for i := 0; i < 2*maxOutliers; i++ {
+		ps.observe(st, p, time.Second, time.Now(), conn)
+	}
+	require.LessOrEqual(t, len(ps.Outliers(p)), maxOutliers)
+
+	ps.removeSession(p)
+	require.Empty(t, ps.Outliers(p))
+}
+
+type mockConn struct {
+	network.Conn
+	local, remote ma.Multiaddr
+}
+
+func (c *mockConn) ID() string { return "conn" }
+func (c *mockConn) Stat() network.ConnStats {
+	return network.ConnStats{Stats: network.Stats{Direction: network.DirOutbound}}
+}
+func (c *mockConn) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c *mockConn) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
+func TestSuppressRepeatedErrors(t *testing.T) {
+	ps := newPingService(nil)
+	ps.errorDedup = time.Minute
+	st := ps.addSession("peer")
+	now := time.Now()
+
+	require.False(t, ps.suppressError(st, true, now))
+	require.True(t, ps.suppressError(st, true, now.Add(time.Second)))
+	require.False(t, ps.suppressError(st, true, now.Add(2*time.Minute)))
+	require.True(t, ps.suppressError(st, true, now.Add(2*time.Minute+time.Second)))
+	// a success resets the state
+	require.False(t, ps.suppressError(st, false, now.Add(3*time.Minute)))
+	require.False(t, ps.suppressError(st, true, now.Add(3*time.Minute)))
+}
+
+func TestSmoothingHalfLife(t *testing.T) {
+	ps := newPingService(nil)
+	require.NoError(t, SmoothingHalfLife(time.Second)(ps))
+	p := peer.ID("peer")
+	st := ps.addSession(p)
+	conn := &mockConn{local: ma.StringCast("/ip4/127.0.0.1/tcp/1"), remote: ma.StringCast("/ip4/127.0.0.1/tcp/2")}
+
+	start := time.Now()
+	ps.observe(st, p, 10*time.Millisecond, start, conn)
+	require.Equal(t, 10*time.Millisecond, st.smoothed)
+	// after one half-life, the old estimate and the sample weigh the same
+	ps.observe(st, p, 30*time.Millisecond, start.Add(time.Second), conn)
+	require.Equal(t, 20*time.Millisecond, st.smoothed)
+	// samples taken at the same instant don't move the estimate
+	ps.observe(st, p, time.Second, start.Add(time.Second), conn)
+	require.Equal(t, 20*time.Millisecond, st.smoothed)
+	// after a long gap, the sample dominates
+	ps.observe(st, p, 50*time.Millisecond, start.Add(time.Minute), conn)
+	require.InDelta(t, float64(50*time.Millisecond), float64(st.smoothed), float64(time.Microsecond))
+}
+
+func TestHealthTransitions(t *testing.T) {
+	ps := newPingService(nil)
+	type transition struct {
+		p       peer.ID
+		healthy bool
+	}
+	var transitions []transition
+	require.NoError(t, HealthSink(func(p peer.ID, healthy bool) {
+		transitions = append(transitions, transition{p, healthy})
+	})(ps))
+	require.NoError(t, HealthThresholds(2, 3)(ps))
+	require.Error(t, HealthThresholds(0, 1)(ps))
+
+	p := peer.ID("peer")
+	st := ps.addSession(p)
+	ok, failed := Result{}, Result{Error: errors.New("failed")}
+	for _, res := range []Result{ok, failed, ok, ok, ok, failed, failed, ok, failed, failed, failed, failed} {
+		ps.track(st, p, res)
+	}
+	require.Equal(t, []transition{{p, true}, {p, false}}, transitions)
+}
+
+func TestRecordLatencyFilter(t *testing.T) {
+	ps := newPingService(nil)
+	require.Error(t, RecordLatencyFilter(1)(ps))
+	st := ps.addSession("peer")
+	// without a filter, everything is recorded
+	require.True(t, ps.plausible(st, time.Hour))
+
+	require.NoError(t, RecordLatencyFilter(2)(ps))
+	// without a smoothed RTT yet
+	require.True(t, ps.plausible(st, time.Hour))
+	st.smoothed = 10 * time.Millisecond
+	require.True(t, ps.plausible(st, 15*time.Millisecond))
+	require.True(t, ps.plausible(st, 20*time.Millisecond))
+	require.False(t, ps.plausible(st, 25*time.Millisecond))
+}
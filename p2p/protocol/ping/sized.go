@@ -0,0 +1,224 @@
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SizedID is a variant of the ping protocol with payloads of variable size.
+// Every payload is prefixed with its length as an unsigned varint, and echoed
+// back without the prefix. It is only served with ServeExtensions.
+const SizedID = "/ipfs/ping/sized/1.0.0"
+
+// MaxPayloadSize is the largest payload accepted by the SizedID handler.
+const MaxPayloadSize = 64 << 10
+
+// timeout of a single round when probing the MTU
+const probeTimeout = 5 * time.Second
+
+// VerificationMode is how the echoes of SizedID payloads are verified, see
+// VerifyMode.
+type VerificationMode int
+
+const (
+	// FullCompare compares the echo with the payload byte by byte.
+	FullCompare VerificationMode = iota
+	// Checksum embeds a CRC-32C of the payload in its last bytes, and checks
+	// the checksum of the echo against it.
+	Checksum
+)
+
+// size of the checksum embedded in payloads in Checksum mode
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// seal embeds the checksum of the rest of payload in its last bytes.
+func seal(payload []byte) {
+	n := len(payload) - checksumSize
+	binary.BigEndian.PutUint32(payload[n:], crc32.Checksum(payload[:n], castagnoli))
+}
+
+// verifyChecksum checks that the echo of a sealed payload carries the same
+// checksum, and that the checksum matches its content.
+func verifyChecksum(sent, received []byte) error {
+	if len(received) != len(sent) {
+		return errPayloadMismatch
+	}
+	n := len(received) - checksumSize
+	sum := binary.BigEndian.Uint32(received[n:])
+	if sum != binary.BigEndian.Uint32(sent[n:]) || sum != crc32.Checksum(received[:n], castagnoli) {
+		return errPayloadMismatch
+	}
+	return nil
+}
+
+func (p *PingService) sizedHandler(s network.Stream) {
+	p.handle(s, 0, func([]byte) error {
+		return p.echoSized(s)
+	})
+}
+
+// echoSized reads a length-prefixed payload from s and echoes it back.
+func (p *PingService) echoSized(s network.Stream) error {
+	size, err := binary.ReadUvarint(&byteReader{r: s})
+	if err != nil {
+		return err
+	}
+	if size == 0 || size > MaxPayloadSize {
+		return fmt.Errorf("invalid ping payload size: %d", size)
+	}
+
+	if !p.reserveInboundMemory(int64(size)) {
+		p.metricsTracer.InboundStreamRejected("memory")
+		return errors.New("inbound memory limit reached")
+	}
+	defer p.releaseInboundMemory(int64(size))
+	if err := s.Scope().ReserveMemory(int(size), p.reservePriority); err != nil {
+		return err
+	}
+	defer s.Scope().ReleaseMemory(int(size))
+
+	buf := p.getBuf(int(size))
+	defer p.putBuf(buf)
+
+	if _, err := io.ReadFull(s, buf); err != nil {
+		return err
+	}
+	if !p.noEcho {
+		if err := writeFull(s, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pingSized performs a ping round with a payload of the given size, using the
+// SizedID protocol.
+func (ps *PingService) pingSized(s network.Stream, randReader io.Reader, size int) (DetailedResult, error) {
+	var res DetailedResult
+	if size <= 0 || size > MaxPayloadSize {
+		return res, fmt.Errorf("invalid ping payload size: %d", size)
+	}
+
+	msgSize := binary.MaxVarintLen64 + size
+	if err := s.Scope().ReserveMemory(msgSize+size, ps.reservePriority); err != nil {
+		log.Debugf("error reserving memory for ping stream: %s", err)
+		s.Reset()
+		return res, err
+	}
+	defer s.Scope().ReleaseMemory(msgSize + size)
+
+	buf := ps.getBuf(msgSize)
+	defer ps.putBuf(buf)
+	n := binary.PutUvarint(buf, uint64(size))
+	msg := buf[:n+size]
+	payload := msg[n:]
+
+	if _, err := io.ReadFull(randReader, payload); err != nil {
+		return res, err
+	}
+	checksum := ps.verifyMode == Checksum && ps.verifyFunc == nil && size > checksumSize
+	if checksum {
+		seal(payload)
+	}
+
+	seq := ps.wireSeqs(1)
+	before := time.Now()
+	if err := writeFull(s, msg); err != nil {
+		return res, err
+	}
+	written := time.Now()
+	ps.wireEvent(s, seq, WireWrite, written)
+	res.WriteTime = written.Sub(before)
+
+	rbuf := ps.getBuf(size)
+	defer ps.putBuf(rbuf)
+
+	if _, err := io.ReadFull(s, rbuf); err != nil {
+		return res, err
+	}
+	received := time.Now()
+	ps.wireEvent(s, seq, WireRead, received)
+	res.WaitTime = received.Sub(written)
+
+	ps.keepPayloads(s, payload, rbuf)
+	var err error
+	if checksum {
+		err = verifyChecksum(payload, rbuf)
+	} else {
+		err = ps.verify(payload, rbuf)
+	}
+	if err != nil {
+		return res, err
+	}
+	res.RTT = received.Sub(before)
+	return res, nil
+}
+
+// ProbeMTU pings p with payloads of increasing size, from min to max in
+// increments of step, and returns the largest payload size that round-tripped
+// successfully. Probing stops at the first size that fails.
+// Note that stream transports fragment payloads as needed, so this reports the
+// largest payload the path handles end-to-end rather than the link-layer MTU.
+func ProbeMTU(ctx context.Context, h host.Host, p peer.ID, min, max, step int) (int, error) {
+	if min <= 0 || max > MaxPayloadSize || min > max || step <= 0 {
+		return 0, fmt.Errorf("invalid probe range: [%d, %d] in steps of %d", min, max, step)
+	}
+
+	ps := newPingService(h)
+	ps.payloadSize = min
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, _, err := ps.openStream(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Reset()
+
+	ra, err := newRand()
+	if err != nil {
+		return 0, err
+	}
+
+	largest := 0
+	for size := min; size <= max; size += step {
+		// Oversized payloads may be blackholed rather than fail.
+		t := time.AfterFunc(probeTimeout, func() { s.Reset() })
+		_, err = ps.pingSized(s, ra, size)
+		t.Stop()
+		if err != nil || ctx.Err() != nil {
+			break
+		}
+		largest = size
+	}
+	if largest == 0 {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return 0, err
+	}
+	return largest, nil
+}
+
+// byteReader reads single bytes from a reader.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
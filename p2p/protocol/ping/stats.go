@@ -0,0 +1,304 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// default minimum number of successful rounds for statistics to be reported
+const defaultMinSamples = 3
+
+// ErrInsufficientSamples is returned along with partial statistics when fewer
+// successful rounds than required by the MinSamples option were gathered.
+var ErrInsufficientSamples = errors.New("insufficient successful ping samples")
+
+// Statistics summarizes a series of ping results.
+type Statistics struct {
+	// Sent is the number of ping attempts, Received the number of
+	// successful ones.
+	Sent, Received int
+	// Loss is the fraction of attempts that failed, from 0 to 1.
+	Loss float64
+
+	Min, Max, Mean, StdDev time.Duration
+	// P50, P95 and P99 are RTT percentiles, using the nearest-rank method.
+	P50, P95, P99 time.Duration
+
+	// Jitter is the mean absolute difference between consecutive successful
+	// RTT samples.
+	Jitter time.Duration
+	// InterarrivalJitter is the smoothed RTT variation, computed as the
+	// interarrival jitter of RFC 3550, section 6.4.1.
+	InterarrivalJitter time.Duration
+}
+
+// statsAccumulator computes Statistics incrementally.
+type statsAccumulator struct {
+	sent int
+	rtts []time.Duration
+
+	// running mean and sum of squared deviations (Welford)
+	mean, m2 float64
+
+	jitterSum   time.Duration
+	interarrive float64
+}
+
+func (a *statsAccumulator) add(res Result) {
+	a.sent++
+	if res.Error != nil {
+		return
+	}
+
+	if n := len(a.rtts); n > 0 {
+		d := res.RTT - a.rtts[n-1]
+		if d < 0 {
+			d = -d
+		}
+		a.jitterSum += d
+		a.interarrive += (float64(d) - a.interarrive) / 16
+	}
+	a.rtts = append(a.rtts, res.RTT)
+
+	x := float64(res.RTT)
+	delta := x - a.mean
+	a.mean += delta / float64(len(a.rtts))
+	a.m2 += delta * (x - a.mean)
+}
+
+func (a *statsAccumulator) stats() Statistics {
+	st := Statistics{Sent: a.sent, Received: len(a.rtts)}
+	if st.Sent > 0 {
+		st.Loss = float64(st.Sent-st.Received) / float64(st.Sent)
+	}
+	n := len(a.rtts)
+	if n == 0 {
+		return st
+	}
+
+	sorted := make([]time.Duration, n)
+	copy(sorted, a.rtts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	st.Min = sorted[0]
+	st.Max = sorted[n-1]
+	st.P50 = percentile(sorted, 50)
+	st.P95 = percentile(sorted, 95)
+	st.P99 = percentile(sorted, 99)
+
+	st.Mean = time.Duration(a.mean)
+	st.StdDev = time.Duration(math.Sqrt(a.m2 / float64(n)))
+	if n > 1 {
+		st.Jitter = a.jitterSum / time.Duration(n-1)
+	}
+	st.InterarrivalJitter = time.Duration(a.interarrive)
+	return st
+}
+
+// percentile returns the nearest-rank percentile of a sorted, non-empty slice.
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	rank := (pct*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Collect pings p n times and summarizes the results. If the session ends
+// before all rounds completed, it returns the statistics gathered so far along
+// with the context error, or the last ping error if the session stopped on its
+// own. If fewer rounds than set with MinSamples (3 by default) succeeded, it
+// returns the statistics along with ErrInsufficientSamples. n must be at
+// least 1.
+func Collect(ctx context.Context, h host.Host, p peer.ID, n int) (Statistics, error) {
+	return newPingService(h).Collect(ctx, p, n)
+}
+
+// Collect pings p n times and summarizes the results. See the package level
+// Collect.
+func (ps *PingService) Collect(ctx context.Context, p peer.ID, n int) (Statistics, error) {
+	if n < 1 {
+		return Statistics{}, errors.New("number of rounds must be at least 1")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var acc statsAccumulator
+	var lastErr error
+	for res := range ps.Ping(ctx, p) {
+		acc.add(res)
+		if res.Error != nil {
+			lastErr = res.Error
+		}
+		if acc.sent == n {
+			break
+		}
+	}
+	st := acc.stats()
+	if acc.sent < n {
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		return st, lastErr
+	}
+	if st.Received < ps.minSamples {
+		return st, ErrInsufficientSamples
+	}
+	return st, nil
+}
+
+// CollectAtLeast pings p until minSuccess rounds succeeded, counting failed
+// rounds as loss, and summarizes the results. Unlike Collect, it yields enough
+// samples for meaningful statistics on lossy links. If the session ends first,
+// it returns the statistics gathered so far along with an error wrapping the
+// context error, or the last ping error if the session stopped on its own.
+func CollectAtLeast(ctx context.Context, h host.Host, p peer.ID, minSuccess int) (Statistics, error) {
+	return newPingService(h).CollectAtLeast(ctx, p, minSuccess)
+}
+
+// CollectAtLeast pings p until minSuccess rounds succeeded. See the package
+// level CollectAtLeast.
+func (ps *PingService) CollectAtLeast(ctx context.Context, p peer.ID, minSuccess int) (Statistics, error) {
+	if minSuccess < 1 {
+		return Statistics{}, errors.New("minimum number of successful samples must be at least 1")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var acc statsAccumulator
+	var lastErr error
+	for res := range ps.Ping(ctx, p) {
+		acc.add(res)
+		if res.Error != nil {
+			lastErr = res.Error
+		}
+		if len(acc.rtts) == minSuccess {
+			return acc.stats(), nil
+		}
+	}
+	st := acc.stats()
+	err := ctx.Err()
+	if err == nil {
+		err = lastErr
+	}
+	if err == nil {
+		err = errors.New("ping session ended")
+	}
+	return st, fmt.Errorf("collected %d of %d successful samples: %w", st.Received, minSuccess, err)
+}
+
+// Diagnose runs a dense burst of pings to p for the duration d, and summarizes
+// the results. The burst runs back to back rounds with the highest memory
+// reservation priority, every round being measured, and ends after d,
+// regardless of the Schedule, MeasureEvery, ReservationPriority, Count,
+// Duration, StartDelay and ContinueFunc options; all other options apply as
+// configured. It runs independently of other ping sessions, which are
+// unaffected. It returns errors like Collect.
+func (ps *PingService) Diagnose(ctx context.Context, p peer.ID, d time.Duration) (Statistics, error) {
+	burst := newPingService(ps.Host)
+	burst.config = ps.config
+	burst.count = 0
+	burst.duration = 0
+	burst.startDelay = 0
+	burst.continueFunc = nil
+	burst.schedule = 0
+	burst.measureEvery = 0
+	burst.reservePriority = network.ReservationPriorityAlways
+
+	burstCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	var acc statsAccumulator
+	var lastErr error
+	for res := range burst.Ping(burstCtx, p) {
+		acc.add(res)
+		if res.Error != nil {
+			lastErr = res.Error
+		}
+	}
+	st := acc.stats()
+	if err := ctx.Err(); err != nil {
+		return st, err
+	}
+	if burstCtx.Err() == nil {
+		// the session ended on its own
+		return st, lastErr
+	}
+	if st.Received < burst.minSamples {
+		return st, ErrInsufficientSamples
+	}
+	return st, nil
+}
+
+// WaitStable pings p until the RTT settles, that is until the last window
+// rounds all succeeded with a standard deviation of at most maxStdDev. It
+// returns the statistics of that window. If the context is done first, it
+// returns the statistics of the last window along with the context error.
+func WaitStable(ctx context.Context, h host.Host, p peer.ID, window int, maxStdDev time.Duration) (Statistics, error) {
+	if window < 2 {
+		return Statistics{}, errors.New("stability window must hold at least 2 samples")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	recent := make([]Result, 0, window)
+	var st Statistics
+	for res := range Ping(ctx, h, p) {
+		if len(recent) == window {
+			copy(recent, recent[1:])
+			recent = recent[:window-1]
+		}
+		recent = append(recent, res)
+
+		var acc statsAccumulator
+		for _, r := range recent {
+			acc.add(r)
+		}
+		st = acc.stats()
+		if st.Received == window && st.StdDev <= maxStdDev {
+			return st, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return st, err
+	}
+	return st, errors.New("ping session ended before the RTT stabilized")
+}
+
+// WaitForRTT pings p until a round completes within target, and returns its
+// RTT. If the context is done first, it returns the lowest RTT measured so
+// far, if any, along with the context error.
+func WaitForRTT(ctx context.Context, h host.Host, p peer.ID, target time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var best time.Duration
+	var lastErr error
+	for res := range Ping(ctx, h, p) {
+		if res.Error != nil {
+			lastErr = res.Error
+			continue
+		}
+		if res.RTT <= target {
+			return res.RTT, nil
+		}
+		if best == 0 || res.RTT < best {
+			best = res.RTT
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return best, err
+	}
+	if lastErr != nil {
+		return best, lastErr
+	}
+	return best, errors.New("ping session ended before reaching the target RTT")
+}
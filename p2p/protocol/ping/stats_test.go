@@ -0,0 +1,36 @@
+package ping
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatistics(t *testing.T) {
+	var acc statsAccumulator
+	for _, rtt := range []time.Duration{10, 20, 0, 15, 30} {
+		res := Result{RTT: rtt * time.Millisecond}
+		if rtt == 0 {
+			res = Result{Error: errors.New("timeout")}
+		}
+		acc.add(res)
+	}
+
+	st := acc.stats()
+	require.Equal(t, 5, st.Sent)
+	require.Equal(t, 4, st.Received)
+	require.InDelta(t, 0.2, st.Loss, 1e-9)
+	require.Equal(t, 10*time.Millisecond, st.Min)
+	require.Equal(t, 30*time.Millisecond, st.Max)
+	require.Equal(t, 18750*time.Microsecond, st.Mean)
+	require.InDelta(t, float64(7395*time.Microsecond), float64(st.StdDev), float64(time.Microsecond))
+	require.Equal(t, 15*time.Millisecond, st.P50)
+	require.Equal(t, 30*time.Millisecond, st.P99)
+	// |20-10| + |15-20| + |30-15| over 3 differences
+	require.Equal(t, 10*time.Millisecond, st.Jitter)
+	require.NotZero(t, st.InterarrivalJitter)
+
+	require.Equal(t, Statistics{}, (&statsAccumulator{}).stats())
+}
@@ -0,0 +1,64 @@
+package ping
+
+import (
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PeerStatus is a snapshot of the connectivity and latency of a peer, as
+// returned by Status. The latency fields are only set while there are active
+// outbound ping sessions to the peer.
+type PeerStatus struct {
+	Peer          peer.ID
+	Connectedness network.Connectedness
+	// Transports are the transports of the open connections to the peer,
+	// see Result.Transport, sorted and without duplicates.
+	Transports []string
+
+	// Sessions is the number of active outbound ping sessions to the peer.
+	Sessions    int
+	SmoothedRTT time.Duration
+	// Loss is the fraction of failed attempts since the first active
+	// session started, from 0 to 1.
+	Loss float64
+	// LastError is the error of the last attempt, nil if it succeeded.
+	LastError error
+	// LastSample is when the last successful round was started.
+	LastSample time.Time
+}
+
+// Status returns a snapshot of the connectivity of p, from the host's
+// network state, and of its latency, from the active ping sessions to p.
+func (ps *PingService) Status(p peer.ID) PeerStatus {
+	status := PeerStatus{
+		Peer:          p,
+		Connectedness: ps.Host.Network().Connectedness(p),
+	}
+	seen := make(map[string]bool)
+	for _, c := range ps.Host.Network().ConnsToPeer(p) {
+		name := transportName(c.RemoteMultiaddr())
+		if !seen[name] {
+			seen[name] = true
+			status.Transports = append(status.Transports, name)
+		}
+	}
+	sort.Strings(status.Transports)
+
+	ps.peersMx.Lock()
+	defer ps.peersMx.Unlock()
+	st, ok := ps.peers[p]
+	if !ok {
+		return status
+	}
+	status.Sessions = st.sessions
+	status.SmoothedRTT = st.smoothed
+	if st.attempts > 0 {
+		status.Loss = float64(st.failures) / float64(st.attempts)
+	}
+	status.LastError = st.last.Error
+	status.LastSample = st.lastSample
+	return status
+}
@@ -0,0 +1,73 @@
+package ping
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// StreamEventKind is the kind of lifecycle transition of an outbound ping
+// stream.
+type StreamEventKind int
+
+const (
+	// StreamOpened is reported when a session opens its first stream, or a
+	// new stream for a round with FreshStreamPerRound or after a rotation.
+	StreamOpened StreamEventKind = iota
+	// StreamReopened is reported when a stream is opened to replace a
+	// failed one.
+	StreamReopened
+	// StreamReset is reported when a stream is reset after a failed round.
+	StreamReset
+	// StreamClosed is reported when a stream is closed after a round with
+	// FreshStreamPerRound.
+	StreamClosed
+	// StreamResynced is reported instead of StreamReopened when the failed
+	// stream was replaced because of a payload mismatch, in resilient mode.
+	StreamResynced
+	// StreamRotated is reported when a stream is closed to be replaced, as
+	// set with StreamRotateInterval.
+	StreamRotated
+	// StreamMigrated is reported instead of StreamOpened when a stream over
+	// a transient connection was replaced by one over a direct connection,
+	// in resilient mode.
+	StreamMigrated
+)
+
+func (k StreamEventKind) String() string {
+	switch k {
+	case StreamOpened:
+		return "opened"
+	case StreamReopened:
+		return "reopened"
+	case StreamReset:
+		return "reset"
+	case StreamClosed:
+		return "closed"
+	case StreamResynced:
+		return "resynced"
+	case StreamRotated:
+		return "rotated"
+	case StreamMigrated:
+		return "migrated"
+	default:
+		return "unknown"
+	}
+}
+
+// StreamEvent describes a lifecycle transition of an outbound ping stream, as
+// reported to the OnStreamEvent callback.
+type StreamEvent struct {
+	Peer peer.ID
+	Kind StreamEventKind
+	// Err is the error that caused the transition, for StreamReset.
+	Err error
+	// Transport is the transport of the stream, see Result.Transport.
+	Transport string
+}
+
+// streamEvent reports a lifecycle transition of the session's current
+// stream, if a callback is set.
+func (sess *session) streamEvent(kind StreamEventKind, err error) {
+	if sess.ps.onStreamEvent != nil {
+		sess.ps.onStreamEvent(StreamEvent{Peer: sess.p, Kind: kind, Err: err, Transport: sess.transport})
+	}
+}
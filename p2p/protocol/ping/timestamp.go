@@ -0,0 +1,98 @@
+package ping
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// TimestampID is an extension of the ping protocol. The client embeds its send
+// timestamp in the payload, and the server appends the time it received the
+// payload to the echo. This allows estimating the one-way delay and the clock
+// offset between the two nodes. It is only served with ServeExtensions.
+const TimestampID = "/ipfs/ping/ts/1.0.0"
+
+// TimestampExtID extends TimestampID: the server additionally appends the time
+// it spent between reading the payload and writing the echo, so that it can be
+// told apart from the network delay.
+const TimestampExtID = "/ipfs/ping/ts/1.1.0"
+
+// size of an encoded timestamp, in unix nanoseconds
+const timestampSize = 8
+
+func (p *PingService) timestampHandler(s network.Stream) {
+	p.handle(s, PingSize+timestampSize, func(buf []byte) error {
+		return p.echo(s, buf, func(resp []byte, received time.Time) {
+			binary.BigEndian.PutUint64(resp[PingSize:], uint64(received.UnixNano()))
+		})
+	})
+}
+
+func (p *PingService) timestampExtHandler(s network.Stream) {
+	p.handle(s, PingSize+2*timestampSize, func(buf []byte) error {
+		return p.echo(s, buf, func(resp []byte, received time.Time) {
+			binary.BigEndian.PutUint64(resp[PingSize:], uint64(received.UnixNano()))
+			binary.BigEndian.PutUint64(resp[PingSize+timestampSize:], uint64(time.Since(received)))
+		})
+	})
+}
+
+// pingTimestamped performs a ping round using the timestamp extension, ext
+// being set if TimestampExtID was negotiated.
+func (ps *PingService) pingTimestamped(s network.Stream, randReader io.Reader, ext bool) (DetailedResult, error) {
+	var res DetailedResult
+	respSize := PingSize + timestampSize
+	if ext {
+		respSize += timestampSize
+	}
+	if err := s.Scope().ReserveMemory(PingSize+respSize, ps.reservePriority); err != nil {
+		log.Debugf("error reserving memory for ping stream: %s", err)
+		s.Reset()
+		return res, err
+	}
+	defer s.Scope().ReleaseMemory(PingSize + respSize)
+
+	buf := ps.getBuf(PingSize)
+	defer ps.putBuf(buf)
+
+	if _, err := io.ReadFull(randReader, buf[timestampSize:]); err != nil {
+		return res, err
+	}
+
+	seq := ps.wireSeqs(1)
+	before := time.Now()
+	binary.BigEndian.PutUint64(buf, uint64(before.UnixNano()))
+	if err := writeFull(s, buf); err != nil {
+		return res, err
+	}
+	written := time.Now()
+	ps.wireEvent(s, seq, WireWrite, written)
+	res.WriteTime = written.Sub(before)
+
+	rbuf := ps.getBuf(respSize)
+	defer ps.putBuf(rbuf)
+
+	if _, err := io.ReadFull(s, rbuf); err != nil {
+		return res, err
+	}
+	received := time.Now()
+	ps.wireEvent(s, seq, WireRead, received)
+	res.WaitTime = received.Sub(written)
+
+	ps.keepPayloads(s, buf, rbuf)
+	if err := ps.verify(buf, rbuf[:PingSize]); err != nil {
+		return res, err
+	}
+	res.RTT = received.Sub(before)
+
+	remoteReceived := time.Unix(0, int64(binary.BigEndian.Uint64(rbuf[PingSize:])))
+	if ext {
+		res.ServerProcessing = time.Duration(binary.BigEndian.Uint64(rbuf[PingSize+timestampSize:]))
+	}
+	res.OneWayDelay = remoteReceived.Sub(before)
+	res.ClockOffset = remoteReceived.Sub(before.Add((res.RTT - res.ServerProcessing) / 2))
+
+	return res, nil
+}
@@ -0,0 +1,48 @@
+package ping
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Tracer is notified of every measured outbound ping round, to export it as a
+// span in a distributed trace. An adapter over an OpenTelemetry trace.Tracer
+// starts a span with trace.WithTimestamp(span.Start), sets the attributes,
+// records span.Err if set, and ends it with trace.WithTimestamp(span.End).
+type Tracer interface {
+	// Round is called once a round completed. ctx is the context the ping
+	// session was started with, carrying the parent span if any.
+	Round(ctx context.Context, span RoundSpan)
+}
+
+// RoundSpan describes a ping round for a Tracer.
+type RoundSpan struct {
+	Peer peer.ID
+	// Start is when the payload was written, End when its echo was
+	// received. For failed rounds, End is when the round failed.
+	Start, End time.Time
+	RTT        time.Duration
+	Transport  string
+	Err        error
+}
+
+// traceRound reports a completed round to the tracer, if set.
+func (ps *PingService) traceRound(ctx context.Context, p peer.ID, start time.Time, res Result) {
+	if ps.tracer == nil {
+		return
+	}
+	end := time.Now()
+	if res.Error == nil {
+		start = end.Add(-res.RTT)
+	}
+	ps.tracer.Round(ctx, RoundSpan{
+		Peer:      p,
+		Start:     start,
+		End:       end,
+		RTT:       res.RTT,
+		Transport: res.Transport,
+		Err:       res.Error,
+	})
+}
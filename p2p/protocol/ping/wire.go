@@ -0,0 +1,70 @@
+package ping
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// WireEventKind tells whether a WireEvent reports a payload write or an echo
+// read.
+type WireEventKind int
+
+const (
+	// WireWrite is reported once a payload was handed to the stream.
+	WireWrite WireEventKind = iota
+	// WireRead is reported once the echo of a payload was read.
+	WireRead
+)
+
+func (k WireEventKind) String() string {
+	switch k {
+	case WireWrite:
+		return "write"
+	case WireRead:
+		return "read"
+	default:
+		return "unknown"
+	}
+}
+
+// WireEvent reports when a ping payload of an outbound round was written, or
+// its echo read, as set with OnWire.
+type WireEvent struct {
+	// Peer and Conn, the ID of the connection the payload went over, are
+	// unset for rounds over a RawStream.
+	Peer peer.ID
+	Conn string
+	Kind WireEventKind
+	// Seq identifies the payload, the write and read of a payload sharing the
+	// same Seq. It increases with every payload sent by the service.
+	Seq uint64
+	// Time is when the write returned or the read completed, with the
+	// precision of the system clock, down to the nanosecond.
+	Time time.Time
+}
+
+// wireSeqs reserves n consecutive payload sequence numbers and returns the
+// first one. It returns 0 if no OnWire callback is set.
+func (ps *PingService) wireSeqs(n int) uint64 {
+	if ps.onWire == nil {
+		return 0
+	}
+	return atomic.AddUint64(&ps.wireSeq, uint64(n)) - uint64(n) + 1
+}
+
+// wireEvent reports a payload write or echo read over s, if an OnWire
+// callback is set.
+func (ps *PingService) wireEvent(s RawStream, seq uint64, kind WireEventKind, at time.Time) {
+	if ps.onWire == nil {
+		return
+	}
+	ev := WireEvent{Kind: kind, Seq: seq, Time: at}
+	if ns, ok := s.(network.Stream); ok {
+		ev.Peer = ns.Conn().RemotePeer()
+		ev.Conn = ns.Conn().ID()
+	}
+	ps.onWire(ev)
+}